@@ -3,10 +3,17 @@ package app
 import (
 	"net/http"
 
+	"github.com/gabrielf/datastore-sandbox/src/admin"
 	"github.com/gabrielf/datastore-sandbox/src/categories"
+	"github.com/gabrielf/datastore-sandbox/src/counter"
+	"github.com/gabrielf/datastore-sandbox/src/job"
 	"github.com/gabrielf/datastore-sandbox/src/learning"
+	"github.com/gabrielf/datastore-sandbox/src/migration"
 	"github.com/gabrielf/datastore-sandbox/src/neterrors"
 	"github.com/gabrielf/datastore-sandbox/src/task"
+	"github.com/gabrielf/datastore-sandbox/src/trace"
+	"github.com/gabrielf/datastore-sandbox/src/transaction"
+	"github.com/gabrielf/datastore-sandbox/src/workflow"
 )
 
 func init() {
@@ -14,26 +21,67 @@ func init() {
 }
 
 func RegisterRoutes() {
-	http.HandleFunc("/", categories.Index)
-	http.HandleFunc("/test", categories.TestEventualConsistency)
+	handleTraced("/", categories.Index)
+	handleTraced("/test", categories.TestEventualConsistency)
+	handleTraced("/lookup", categories.Lookup)
+	handleTraced("/versions", categories.Versions)
+	handleTraced("/versions/diff", categories.DiffVersions)
+	handleTraced("/followup/category", categories.CreateWithFollowUp)
+	handleJob(categories.CategoryCreatedJob)
+	handleJob(categories.CategoryMovedJob)
 
-	http.HandleFunc("/meta", learning.Meta)
-	http.HandleFunc("/echo", learning.Echo)
-	http.HandleFunc("/log", learning.CreateLogEntry)
-	http.HandleFunc("/logtrans", learning.CreateLogEntryInTransaction)
+	handleTraced("/meta", learning.Meta)
+	handleTraced("/echo", learning.Echo)
+	handleTraced("/log", learning.CreateLogEntry)
+	handleTraced("/logtrans", learning.CreateLogEntryInTransaction)
+	handleTraced("/log/entries", learning.ListLogEntries)
+	handleTraced("/log/retention", learning.LogRetention)
+	handleTraced("/followup/log", learning.CreateLogEntryWithFollowUp)
+	handleJob(learning.LogEntryAddedJob)
+	handleTraced("/roots", learning.Roots)
+	handleTraced("/roots/", learning.Roots)
+	handleTraced("/counters", counter.Show)
+	handleTraced("/benchmark/contention", learning.BenchmarkContention)
+	handleTraced("/xg/move", learning.MoveLogEntry)
+	handleTraced("/xg/groups", learning.TouchEntityGroups)
+	handleTraced("/transactions/stats", transaction.Stats)
+	handleTraced("/transactions/markers/expire", transaction.ExpireMarkers)
+
+	// Migrations
+	handleTraced("/migrations", migration.Index)
+	handleTraced("/migrations/resume", migration.Resume)
+
+	// Admin
+	handleTraced("/admin/data", admin.DataBrowser)
+	handleTraced("/admin/data/", admin.DataBrowser)
+	handleTraced("/admin/queues", admin.Queues)
+	handleTraced("/admin/queues/", admin.Queues)
 
 	// Task related routes
-	http.HandleFunc("/triggerSleepTask", task.TriggerSleepTask)
-	http.HandleFunc("/triggerSleepTaskUsingDelay", task.TriggerSleepTaskUsingDelay)
-	http.HandleFunc("/sleep", task.Sleep)
-	http.HandleFunc("/triggerUnstableTask", task.TriggerUnstableTask)
-	http.HandleFunc("/unstable", task.Unstable)
-	http.HandleFunc("/triggerProtectedTask", task.TriggerProtectedTask)
-	http.HandleFunc("/protected", task.Protected)
-	http.HandleFunc("/triggerParamsTask", task.TriggerParamsTask)
-	http.HandleFunc("/params", task.Params)
-	http.HandleFunc("/whichServiceForTask", task.WhichServiceDoesATaskRunOn)
-	http.HandleFunc("/taskWithETA", task.TaskWithETA)
+	handleTraced("/jobs", job.Status)
+	handleTraced("/jobs/dead", job.DeadLetters)
+	handleTraced("/triggerSleepTask", task.TriggerSleepTask)
+	handleTraced("/triggerSleepTaskUsingDelay", task.TriggerSleepTaskUsingDelay)
+	handleTraced("/sleep", task.Sleep)
+	handleJob(task.SleepJob)
+	handleTraced("/triggerUnstableTask", task.TriggerUnstableTask)
+	handleJob(task.UnstableJob)
+	handleTraced("/triggerProtectedTask", task.TriggerProtectedTask)
+	handleJob(task.ProtectedJob)
+	handleTraced("/triggerParamsTask", task.TriggerParamsTask)
+	handleTraced("/triggerBatch", task.TriggerBatch)
+	handleTraced("/triggerFanOut", task.TriggerFanOut)
+	handleTraced("/workflows", workflow.Status)
+	handleJob(task.ParamsJob)
+	handleTraced("/experiments/retries", task.RetryTimings)
+	handleTraced("/experiments/tombstone", task.Tombstone)
+	handleTraced("/pull/add", task.AddPullTask)
+	handleTraced("/pull/lease", task.LeasePullTasks)
+	handleTraced("/pull/modify", task.ModifyPullTaskLease)
+	handleTraced("/pull/delete", task.DeletePullTask)
+	handleTraced("/pull/work", task.PullWorker)
+	handleTraced("/whichServiceForTask", task.WhichServiceDoesATaskRunOn)
+	handleTraced("/taskWithETA", task.TaskWithETA)
 
 	// Errors
 	http.HandleFunc("/errors/timeout1", neterrors.Timeout1)
@@ -45,3 +93,14 @@ func RegisterRoutes() {
 	http.HandleFunc("/errors/connection_close1", neterrors.ConnectionClose1)
 	http.HandleFunc("/errors/connection_close2", neterrors.ConnectionClose2)
 }
+
+// handleTraced registers a handler whose datastore operations are logged and
+// optionally reported in a Server-Timing header.
+func handleTraced(pattern string, handler http.HandlerFunc) {
+	http.Handle(pattern, trace.Handler(handler))
+}
+
+// handleJob registers a job type at its path, traced like other handlers.
+func handleJob(t *job.Type) {
+	http.Handle(t.Path, trace.Handler(t))
+}
@@ -0,0 +1,409 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gabrielf/datastore-sandbox/src/repository"
+	"github.com/gabrielf/datastore-sandbox/src/transaction"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/user"
+)
+
+const pageSize = 50
+
+type entity struct {
+	Key        string
+	Path       string
+	Properties []property
+	CSRF       string `json:",omitempty"`
+}
+
+type property struct {
+	Name     string
+	Type     string
+	Value    interface{}
+	NoIndex  bool
+	Multiple bool
+	Editable bool `json:"-"`
+}
+
+type kindPage struct {
+	Kind     string
+	Entities []entity
+	Cursor   string `json:",omitempty"`
+}
+
+// DataBrowser lets admins inspect and edit entities of any kind:
+//
+//	/admin/data                  lists all kinds
+//	/admin/data/kind?kind=K      pages through entities of kind K
+//	/admin/data/entity?key=K     shows one entity, POST edits or deletes it
+//
+// Responses are HTML unless format=json is given or JSON is accepted. POSTs
+// must carry the CSRF token included in the entity page, as the "csrf" form
+// value or an X-CSRF-Token header.
+func DataBrowser(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	// app.yaml already requires an admin login, this guards against that
+	// being changed by mistake.
+	if !user.IsAdmin(ctx) {
+		http.Error(w, "Admins only", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch strings.TrimSuffix(r.URL.Path, "/") {
+	case "/admin/data":
+		listKinds(ctx, w, r)
+	case "/admin/data/kind":
+		listEntities(ctx, w, r)
+	case "/admin/data/entity":
+		if r.Method == "POST" {
+			if !checkCSRF(ctx, w, r) {
+				return
+			}
+			editEntity(ctx, w, r)
+		} else {
+			showEntity(ctx, w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func listKinds(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	repo := repository.New("__kind__")
+	keys, err := repo.GetAll(ctx, repo.NewQuery().KeysOnly(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	kinds := []string{}
+	for _, key := range keys {
+		if !strings.HasPrefix(key.StringID(), "__") {
+			kinds = append(kinds, key.StringID())
+		}
+	}
+	render(w, r, kindsTemplate, kinds)
+}
+
+func listEntities(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	kind := r.Form.Get("kind")
+	if kind == "" {
+		http.Error(w, "Missing kind parameter", http.StatusBadRequest)
+		return
+	}
+
+	repo := repository.New(kind)
+	var entities []datastore.PropertyList
+	keys, cursor, err := repo.Page(ctx, repo.NewQuery(), r.Form.Get("cursor"), pageSize, &entities)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page := kindPage{Kind: kind, Entities: []entity{}, Cursor: cursor}
+	for i, key := range keys {
+		page.Entities = append(page.Entities, toEntity(key, entities[i]))
+	}
+	render(w, r, kindTemplate, page)
+}
+
+func showEntity(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	key, err := datastore.DecodeKey(r.Form.Get("key"))
+	if err != nil {
+		http.Error(w, "Invalid key parameter", http.StatusBadRequest)
+		return
+	}
+
+	var props datastore.PropertyList
+	if err := repository.New(key.Kind()).Get(ctx, key, &props); err == datastore.ErrNoSuchEntity {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	e := toEntity(key, props)
+	if e.CSRF, err = csrfToken(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	render(w, r, entityTemplate, e)
+}
+
+// editEntity sets the property "name" to "value" parsed as "type", or
+// deletes the whole entity if "action" is "delete".
+func editEntity(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	key, err := datastore.DecodeKey(r.Form.Get("key"))
+	if err != nil {
+		http.Error(w, "Invalid key parameter", http.StatusBadRequest)
+		return
+	}
+	repo := repository.New(key.Kind())
+
+	if r.Form.Get("action") == "delete" {
+		if err := repo.Delete(ctx, key); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/admin/data/kind?kind="+url.QueryEscape(key.Kind()), http.StatusSeeOther)
+		return
+	}
+
+	var edit func(props datastore.PropertyList) (datastore.PropertyList, error)
+	if r.Form.Get("action") == "edit" {
+		edit = func(props datastore.PropertyList) (datastore.PropertyList, error) {
+			return editValues(props, r.Form)
+		}
+	} else {
+		name := r.Form.Get("name")
+		if name == "" {
+			http.Error(w, "Missing name parameter", http.StatusBadRequest)
+			return
+		}
+		value, err := parseValue(r.Form.Get("type"), r.Form.Get("value"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		edit = func(props datastore.PropertyList) (datastore.PropertyList, error) {
+			for _, p := range props {
+				if p.Name == name {
+					return nil, badRequest("property %s exists, edit its values instead", name)
+				}
+			}
+			noIndex := r.Form.Get("noindex") == "true"
+			return append(props, datastore.Property{Name: name, Value: value, NoIndex: noIndex}), nil
+		}
+	}
+
+	err = transaction.Run(ctx, transaction.Options{Name: "admin-edit"}, func(ctx context.Context) error {
+		var props datastore.PropertyList
+		if err := repo.Get(ctx, key, &props); err != nil {
+			return err
+		}
+		edited, err := edit(props)
+		if err != nil {
+			return err
+		}
+		_, err = repo.Put(ctx, key, &edited)
+		return err
+	})
+	if err == datastore.ErrNoSuchEntity {
+		http.NotFound(w, r)
+		return
+	}
+	if _, ok := err.(badRequestError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/admin/data/entity?key="+url.QueryEscape(key.Encode()), http.StatusSeeOther)
+}
+
+type badRequestError string
+
+func (e badRequestError) Error() string {
+	return string(e)
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return badRequestError(fmt.Sprintf(format, args...))
+}
+
+// editValues replaces the values of every property given as "value.<name>"
+// form values, one for each value the property has, keeping the type,
+// indexing and multiplicity of each. Properties that aren't given, such as
+// those with types that can't be edited, are kept as they are.
+func editValues(props datastore.PropertyList, form url.Values) (datastore.PropertyList, error) {
+	seen := map[string]int{}
+	edited := make(datastore.PropertyList, len(props))
+	for i, p := range props {
+		edited[i] = p
+		values, ok := form["value."+p.Name]
+		if !ok {
+			continue
+		}
+		n := seen[p.Name]
+		seen[p.Name]++
+		if n >= len(values) {
+			return nil, badRequest("property %s has more values than given", p.Name)
+		}
+		typ, editable := typeName(p.Value)
+		if !editable {
+			return nil, badRequest("property %s can't be edited", p.Name)
+		}
+		value, err := parseValue(typ, values[n])
+		if err != nil {
+			return nil, badRequest("property %s: %s", p.Name, err)
+		}
+		edited[i].Value = value
+	}
+	for name, n := range seen {
+		if n != len(form["value."+name]) {
+			return nil, badRequest("property %s has fewer values than given", name)
+		}
+	}
+	return edited, nil
+}
+
+func parseValue(typ, value string) (interface{}, error) {
+	switch typ {
+	case "", "string":
+		return value, nil
+	case "int":
+		return strconv.ParseInt(value, 10, 64)
+	case "float":
+		return strconv.ParseFloat(value, 64)
+	case "bool":
+		return strconv.ParseBool(value)
+	case "time":
+		return time.Parse(time.RFC3339Nano, value)
+	case "key":
+		return datastore.DecodeKey(value)
+	case "null":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported type %q", typ)
+}
+
+func toEntity(key *datastore.Key, props datastore.PropertyList) entity {
+	e := entity{Key: key.Encode(), Path: key.String(), Properties: []property{}}
+	for _, p := range props {
+		value := p.Value
+		typ, editable := typeName(value)
+		switch v := value.(type) {
+		case *datastore.Key:
+			value = v.Encode()
+		case time.Time:
+			value = v.Format(time.RFC3339Nano)
+		}
+		e.Properties = append(e.Properties, property{
+			Name:     p.Name,
+			Type:     typ,
+			Value:    value,
+			NoIndex:  p.NoIndex,
+			Multiple: p.Multiple,
+			Editable: editable,
+		})
+	}
+	return e
+}
+
+// typeName returns the name parseValue knows the type of value by, and false
+// if it can't parse values of that type.
+func typeName(value interface{}) (string, bool) {
+	switch value.(type) {
+	case string:
+		return "string", true
+	case *datastore.Key:
+		return "key", true
+	case time.Time:
+		return "time", true
+	case int64:
+		return "int", true
+	case float64:
+		return "float", true
+	case bool:
+		return "bool", true
+	case nil:
+		return "null", true
+	}
+	return fmt.Sprintf("%T", value), false
+}
+
+func render(w http.ResponseWriter, r *http.Request, t *template.Template, data interface{}) {
+	if r.Form.Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+var kindsTemplate = template.Must(template.New("kinds").Parse(`<!DOCTYPE html>
+<title>Kinds</title>
+<h1>Kinds</h1>
+<ul>
+{{range .}}<li><a href="/admin/data/kind?kind={{.}}">{{.}}</a></li>
+{{else}}<li>No kinds</li>
+{{end}}</ul>
+`))
+
+var kindTemplate = template.Must(template.New("kind").Parse(`<!DOCTYPE html>
+<title>{{.Kind}}</title>
+<p><a href="/admin/data">Kinds</a></p>
+<h1>{{.Kind}}</h1>
+<table border="1">
+<tr><th>Key</th><th>Properties</th></tr>
+{{range .Entities}}<tr>
+<td><a href="/admin/data/entity?key={{.Key}}">{{.Path}}</a></td>
+<td>{{range .Properties}}{{.Name}}={{.Value}}<br>{{end}}</td>
+</tr>
+{{end}}</table>
+{{if .Cursor}}<p><a href="/admin/data/kind?kind={{.Kind}}&amp;cursor={{.Cursor}}">Next page</a></p>{{end}}
+`))
+
+var entityTemplate = template.Must(template.New("entity").Parse(`<!DOCTYPE html>
+<title>{{.Path}}</title>
+<p><a href="/admin/data">Kinds</a></p>
+<h1>{{.Path}}</h1>
+<form method="POST">
+<input type="hidden" name="key" value="{{.Key}}">
+<input type="hidden" name="action" value="edit">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<table border="1">
+<tr><th>Name</th><th>Type</th><th>Value</th><th>Indexed</th></tr>
+{{range .Properties}}<tr><td>{{.Name}}{{if .Multiple}} (multiple){{end}}</td><td>{{.Type}}</td>
+<td>{{if .Editable}}<input name="value.{{.Name}}" value="{{.Value}}">{{else}}{{.Value}}{{end}}</td>
+<td>{{if .NoIndex}}no{{else}}yes{{end}}</td></tr>
+{{end}}</table>
+<button>Save</button>
+</form>
+<h2>Add property</h2>
+<form method="POST">
+<input type="hidden" name="key" value="{{.Key}}">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<input name="name" placeholder="Name">
+<select name="type">
+<option>string</option><option>int</option><option>float</option><option>bool</option>
+<option>time</option><option>key</option><option>null</option>
+</select>
+<input name="value" placeholder="Value">
+<label><input type="checkbox" name="noindex" value="true"> Not indexed</label>
+<button>Add</button>
+</form>
+<h2>Delete entity</h2>
+<form method="POST">
+<input type="hidden" name="key" value="{{.Key}}">
+<input type="hidden" name="action" value="delete">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<button>Delete</button>
+</form>
+`))
@@ -0,0 +1,97 @@
+package admin
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+
+	"github.com/gabrielf/datastore-sandbox/src/repository"
+	"github.com/gabrielf/datastore-sandbox/src/transaction"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/user"
+)
+
+// csrfField is the form field, or header, state-changing requests must carry
+// the token in.
+const csrfField = "csrf"
+
+// secret is the key CSRF tokens are derived with. It's created once and
+// shared by all instances through datastore.
+type secret struct {
+	Value []byte `datastore:",noindex"`
+}
+
+var (
+	secretRepository = repository.New("AdminSecret")
+	secretMu         sync.Mutex
+	csrfSecret       []byte
+)
+
+// csrfToken returns the token of the signed in user. The login cookie is sent
+// along with cross-site requests as well, the token isn't since other sites
+// can't read the pages it's in.
+func csrfToken(ctx context.Context) (string, error) {
+	key, err := getSecret(ctx)
+	if err != nil {
+		return "", err
+	}
+	u := user.Current(ctx)
+	if u == nil {
+		return "", nil
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(u.ID + "/" + u.Email))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// checkCSRF responds 403 and returns false unless r carries the token of the
+// signed in user.
+func checkCSRF(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	expected, err := csrfToken(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	token := r.PostFormValue(csrfField)
+	if token == "" {
+		token = r.Header.Get("X-CSRF-Token")
+	}
+	if expected == "" || !hmac.Equal([]byte(token), []byte(expected)) {
+		http.Error(w, "Missing or invalid CSRF token", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func getSecret(ctx context.Context) ([]byte, error) {
+	secretMu.Lock()
+	defer secretMu.Unlock()
+	if csrfSecret != nil {
+		return csrfSecret, nil
+	}
+
+	key := secretRepository.NewKey(ctx, "csrf", 0, nil)
+	var s secret
+	err := transaction.Run(ctx, transaction.Options{Name: "admin-secret"}, func(ctx context.Context) error {
+		s = secret{}
+		err := secretRepository.Get(ctx, key, &s)
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		s.Value = make([]byte, 32)
+		if _, err := rand.Read(s.Value); err != nil {
+			return err
+		}
+		_, err = secretRepository.Put(ctx, key, &s)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	csrfSecret = s.Value
+	return csrfSecret, nil
+}
@@ -0,0 +1,147 @@
+package admin
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gabrielf/datastore-sandbox/src/task"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+	"google.golang.org/appengine/user"
+)
+
+type queueStats struct {
+	Name            string
+	Tasks           int
+	OldestETA       time.Time
+	Executed1Minute int
+	InFlight        int
+	EnforcedRate    float64
+}
+
+type queuesPage struct {
+	Queues []queueStats
+	CSRF   string
+}
+
+// Queues lets admins inspect and manage the task queues:
+//
+//	/admin/queues                     shows the stats of all queues
+//	/admin/queues/purge?queue=Q       POST deletes all tasks of queue Q
+//	/admin/queues/task?queue=Q&name=N POST deletes the task N of queue Q
+//
+// Responses are HTML unless format=json is given or JSON is accepted. POSTs
+// must carry the CSRF token included in the queues page, like those of
+// DataBrowser.
+func Queues(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	if !user.IsAdmin(ctx) {
+		http.Error(w, "Admins only", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	if path == "/admin/queues" {
+		showQueues(ctx, w, r)
+		return
+	}
+	if path != "/admin/queues/purge" && path != "/admin/queues/task" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkCSRF(ctx, w, r) {
+		return
+	}
+
+	queue := r.Form.Get("queue")
+	if !knownQueue(queue) {
+		http.Error(w, "Unknown queue", http.StatusBadRequest)
+		return
+	}
+	if path == "/admin/queues/purge" {
+		if err := taskqueue.Purge(ctx, queue); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof(ctx, "Purged queue %s", queue)
+	} else {
+		name := r.Form.Get("name")
+		if name == "" {
+			http.Error(w, "Missing name parameter", http.StatusBadRequest)
+			return
+		}
+		if err := taskqueue.Delete(ctx, &taskqueue.Task{Name: name}, queue); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof(ctx, "Deleted task %s of queue %s", name, queue)
+	}
+	http.Redirect(w, r, "/admin/queues", http.StatusSeeOther)
+}
+
+func showQueues(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	stats, err := taskqueue.QueueStats(ctx, task.Queues)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page := queuesPage{Queues: []queueStats{}}
+	for i, s := range stats {
+		page.Queues = append(page.Queues, queueStats{
+			Name:            task.Queues[i],
+			Tasks:           s.Tasks,
+			OldestETA:       s.OldestETA,
+			Executed1Minute: s.Executed1Minute,
+			InFlight:        s.InFlight,
+			EnforcedRate:    s.EnforcedRate,
+		})
+	}
+	if page.CSRF, err = csrfToken(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	render(w, r, queuesTemplate, page)
+}
+
+func knownQueue(name string) bool {
+	for _, queue := range task.Queues {
+		if queue == name {
+			return true
+		}
+	}
+	return false
+}
+
+var queuesTemplate = template.Must(template.New("queues").Parse(`<!DOCTYPE html>
+<title>Queues</title>
+<h1>Queues</h1>
+<table border="1">
+<tr><th>Queue</th><th>Tasks</th><th>Oldest ETA</th><th>Executed last minute</th><th>In flight</th><th>Enforced rate</th><th></th></tr>
+{{range .Queues}}<tr>
+<td>{{.Name}}</td><td>{{.Tasks}}</td><td>{{if not .OldestETA.IsZero}}{{.OldestETA}}{{end}}</td>
+<td>{{.Executed1Minute}}</td><td>{{.InFlight}}</td><td>{{.EnforcedRate}}/s</td>
+<td><form method="POST" action="/admin/queues/purge"><input type="hidden" name="queue" value="{{.Name}}"><input type="hidden" name="csrf" value="{{$.CSRF}}"><button>Purge</button></form></td>
+</tr>
+{{end}}</table>
+<h2>Delete task</h2>
+<form method="POST" action="/admin/queues/task">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<select name="queue">{{range .Queues}}<option>{{.Name}}</option>{{end}}</select>
+<input name="name" placeholder="Task name">
+<button>Delete</button>
+</form>
+`))
@@ -0,0 +1,172 @@
+package categories
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Keys cost one entity read each, fetched together. Names cost a keys-only
+// query each, two if the name is a translation, so fewer are allowed.
+const (
+	maxLookups           = 100
+	maxNameLookups       = 20
+	maxConcurrentQueries = 10
+)
+
+// LookupResult is the outcome of looking up one key or name. Results are
+// returned in the same order as the input with Found set to false for keys
+// and names that didn't match any category.
+type LookupResult struct {
+	Input    string
+	Found    bool
+	Category *Category `json:",omitempty"`
+}
+
+type BatchLookup struct {
+	Keys  []LookupResult
+	Names []LookupResult
+}
+
+// Lookup resolves many categories in one request. Keys are given as repeated
+// "key" form values and fetched with a single GetMulti, names are given as
+// repeated "name" form values and the keys of their categories queried
+// concurrently, a few at a time, before they are fetched with a single
+// GetMulti as well. At most maxLookups keys and names can be given in total,
+// and at most maxNameLookups names.
+func Lookup(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		panic(err)
+	}
+	ctx := appengine.NewContext(r)
+
+	if len(r.Form["key"])+len(r.Form["name"]) > maxLookups {
+		http.Error(w, fmt.Sprintf("At most %d keys and names can be looked up at once", maxLookups), http.StatusBadRequest)
+		return
+	}
+	if len(r.Form["name"]) > maxNameLookups {
+		http.Error(w, fmt.Sprintf("At most %d names can be looked up at once", maxNameLookups), http.StatusBadRequest)
+		return
+	}
+
+	result := BatchLookup{
+		Keys:  lookupByKeys(ctx, r.Form["key"]),
+		Names: lookupByNames(ctx, r.Form["name"]),
+	}
+
+	locales := requestedLocales(r)
+	for _, results := range [][]LookupResult{result.Keys, result.Names} {
+		for _, item := range results {
+			localizeResult(item.Category, locales)
+		}
+	}
+
+	w.Header().Set("Vary", "Accept-Language")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		panic(err)
+	}
+}
+
+func lookupByKeys(ctx context.Context, encodedKeys []string) []LookupResult {
+	results := make([]LookupResult, len(encodedKeys))
+	keys := make([]*datastore.Key, len(encodedKeys))
+	for i, encodedKey := range encodedKeys {
+		results[i].Input = encodedKey
+		key, err := datastore.DecodeKey(encodedKey)
+		if err != nil || key.Kind() != "Category" {
+			continue
+		}
+		keys[i] = key
+	}
+	getCategories(ctx, keys, results)
+	return results
+}
+
+// getCategories fetches the categories of the keys that aren't nil with one
+// GetMulti and sets them on the result at the same index.
+func getCategories(ctx context.Context, allKeys []*datastore.Key, results []LookupResult) {
+	var keys []*datastore.Key
+	var positions []int
+	for i, key := range allKeys {
+		if key != nil {
+			keys = append(keys, key)
+			positions = append(positions, i)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	categories := make([]Category, len(keys))
+	err := categoryRepository.GetMulti(ctx, keys, categories)
+	multiErr, isMultiErr := err.(appengine.MultiError)
+	if err != nil && !isMultiErr {
+		panic(err)
+	}
+
+	for i := range keys {
+		if isMultiErr && multiErr[i] != nil {
+			if multiErr[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			panic(multiErr[i])
+		}
+		results[positions[i]].Found = true
+		results[positions[i]].Category = &categories[i]
+	}
+}
+
+func lookupByNames(ctx context.Context, names []string) []LookupResult {
+	results := make([]LookupResult, len(names))
+	keys := make([]*datastore.Key, len(names))
+	errs := make([]error, len(names))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentQueries)
+	for i, name := range names {
+		results[i].Input = name
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			keys[i], errs[i] = queryKeyByName(ctx, name)
+		}(i, name)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// A category deleted since it was queried isn't found, like one renamed
+	// since is found under its old name.
+	getCategories(ctx, keys, results)
+	return results
+}
+
+// queryKeyByName is queryByName returning only the key, or nil if no
+// category has the name.
+func queryKeyByName(ctx context.Context, name string) (*datastore.Key, error) {
+	if name == "" {
+		return nil, nil
+	}
+	for _, filter := range []string{"Name=", "Translations.Name="} {
+		q := categoryRepository.NewQuery().Filter(filter, name).Limit(1).KeysOnly()
+		keys, err := categoryRepository.GetAll(ctx, q, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) > 0 {
+			return keys[0], nil
+		}
+	}
+	return nil, nil
+}
@@ -6,36 +6,75 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/gabrielf/datastore-sandbox/src/repository"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 )
 
+var categoryRepository = repository.New("Category")
+
 type Category struct {
-	Key       *datastore.Key `datastore:"-"`
-	Ancestors []string
-	Name      string
+	Key           *datastore.Key `datastore:"-"`
+	Ancestors     []string
+	Name          string
+	Translations  []Translation
+	Version       int
+	LocalizedName string `datastore:"-" json:",omitempty"`
+	Locale        string `datastore:"-" json:",omitempty"`
+}
+
+func (c *Category) SetKey(key *datastore.Key) {
+	c.Key = key
 }
 
 func Index(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		panic(err)
 	}
+	// Categories are localized by Accept-Language, and every response has to
+	// say so for caches to keep them apart, 304s and 412s included.
+	w.Header().Set("Vary", "Accept-Language")
 
-	if r.Method == "POST" {
+	switch r.Method {
+	case "POST":
 		Create(w, r)
-	} else {
+	case "PUT":
+		Update(w, r)
+	default:
 		Get(w, r)
 	}
 }
 
 func Get(w http.ResponseWriter, r *http.Request) {
+	if r.Form.Get("version") != "" {
+		getPinned(w, r)
+		return
+	}
+
 	ctx := appengine.NewContext(r)
+	locales := requestedLocales(r)
 
 	var result interface{}
-	if r.Form.Get("name") != "" {
-		result = findByName(ctx, r.Form.Get("name"))
+	if r.Form.Get("key") != "" {
+		category := findByKey(ctx, r.Form.Get("key"))
+		if category == nil {
+			http.Error(w, "Category not found", http.StatusNotFound)
+			return
+		}
+		localizeResult(category, locales)
+		if writeETag(w, r, category) {
+			return
+		}
+		result = category
+	} else if r.Form.Get("name") != "" {
+		category := findByName(ctx, r.Form.Get("name"))
+		localizeResult(category, locales)
+		if category != nil && writeETag(w, r, category) {
+			return
+		}
+		result = category
 	} else if r.Form.Get("ancestor") != "" {
 		result = findByAncestorName(ctx, r.Form.Get("ancestor"))
 	} else if r.Form.Get("parent") != "" {
@@ -44,6 +83,7 @@ func Get(w http.ResponseWriter, r *http.Request) {
 		result = findAll(ctx)
 	}
 
+	localizeResult(result, locales)
 	if err := json.NewEncoder(w).Encode(result); err != nil {
 		panic(err)
 	}
@@ -57,13 +97,14 @@ func Create(w http.ResponseWriter, r *http.Request) {
 	category := Category{
 		Name:      r.Form.Get("name"),
 		Ancestors: getAncestorPath(parent),
+		Version:   1,
 	}
-	categoryKey := datastore.NewIncompleteKey(ctx, "Category", nil)
-	var err error
-	if category.Key, err = datastore.Put(ctx, categoryKey, &category); err != nil {
+	setTranslations(&category, r.Form)
+	if _, err := categoryRepository.Put(ctx, categoryRepository.NewIncompleteKey(ctx, nil), &category); err != nil {
 		panic(err)
 	}
 
+	w.Header().Set("ETag", etag(&category))
 	if err := json.NewEncoder(w).Encode(category); err != nil {
 		panic(err)
 	}
@@ -71,13 +112,9 @@ func Create(w http.ResponseWriter, r *http.Request) {
 
 func findAll(ctx context.Context) []Category {
 	var categories []Category
-	keys, err := datastore.NewQuery("Category").GetAll(ctx, &categories)
-	if err != nil {
+	if _, err := categoryRepository.GetAll(ctx, categoryRepository.NewQuery(), &categories); err != nil {
 		panic(err)
 	}
-	for i, _ := range keys {
-		categories[i].Key = keys[i]
-	}
 	return categories
 }
 
@@ -93,13 +130,10 @@ func findByAncestor(ctx context.Context, ancestor *Category) []Category {
 	}
 
 	var categories []Category
-	keys, err := datastore.NewQuery("Category").Filter("Ancestors=", ancestor.Key.Encode()).GetAll(ctx, &categories)
-	if err != nil {
+	q := categoryRepository.NewQuery().Filter("Ancestors=", ancestor.Key.Encode())
+	if _, err := categoryRepository.GetAll(ctx, q, &categories); err != nil {
 		panic(err)
 	}
-	for i, _ := range keys {
-		categories[i].Key = keys[i]
-	}
 
 	return categories
 }
@@ -120,20 +154,51 @@ func findByParentName(ctx context.Context, parentName string) []Category {
 }
 
 func findByName(ctx context.Context, name string) *Category {
+	category, err := queryByName(ctx, name)
+	if err != nil {
+		panic(err)
+	}
+	return category
+}
+
+func queryByName(ctx context.Context, name string) (*Category, error) {
 	if name == "" {
-		return nil
+		return nil, nil
 	}
 
 	var categories []Category
-	keys, err := datastore.NewQuery("Category").Filter("Name=", name).GetAll(ctx, &categories)
-	if err != nil {
-		panic(err)
+	if _, err := categoryRepository.GetAll(ctx, categoryRepository.NewQuery().Filter("Name=", name), &categories); err != nil {
+		return nil, err
+	}
+	if len(categories) == 0 {
+		// Not found by its default name, try the names in all locales
+		q := categoryRepository.NewQuery().Filter("Translations.Name=", name)
+		if _, err := categoryRepository.GetAll(ctx, q, &categories); err != nil {
+			return nil, err
+		}
+	}
+	if len(categories) == 0 {
+		return nil, nil
 	}
-	for i, _ := range categories {
-		categories[i].Key = keys[i]
+
+	return &categories[0], nil
+}
+
+func findByKey(ctx context.Context, encodedKey string) *Category {
+	key, err := datastore.DecodeKey(encodedKey)
+	if err != nil || key.Kind() != "Category" {
+		return nil
+	}
+
+	var category Category
+	if err := categoryRepository.Get(ctx, key, &category); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		panic(err)
 	}
 
-	return &categories[0]
+	return &category
 }
 
 func getAncestorPath(parent *Category) []string {
@@ -157,15 +222,13 @@ func TestEventualConsistency(w http.ResponseWriter, r *http.Request) {
 	category := Category{
 		Name: name,
 	}
-	categoryKey := datastore.NewIncompleteKey(ctx, "Category", nil)
-	var err error
-	if category.Key, err = datastore.Put(ctx, categoryKey, &category); err != nil {
+	if _, err := categoryRepository.Put(ctx, categoryRepository.NewIncompleteKey(ctx, nil), &category); err != nil {
 		panic(err)
 	}
 
 	for {
 		var categories []Category
-		keys, err := datastore.NewQuery("Category").Filter("Name=", name).GetAll(ctx, &categories)
+		keys, err := categoryRepository.GetAll(ctx, categoryRepository.NewQuery().Filter("Name=", name), &categories)
 		if err != nil {
 			panic(err)
 		}
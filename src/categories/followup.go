@@ -0,0 +1,90 @@
+package categories
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gabrielf/datastore-sandbox/src/job"
+	"github.com/gabrielf/datastore-sandbox/src/transaction"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+type CategoryCreatedPayload struct {
+	Key string
+}
+
+var CategoryCreatedJob = job.Register(job.Type{
+	Name:    "category-created",
+	Path:    "/jobs/category-created",
+	Queue:   "slow-queue",
+	Handler: categoryCreated,
+})
+
+// CreateWithFollowUp creates a category like Create and enqueues a follow-up
+// task in the same transaction, so the task is only added if the category is
+// saved. The task is added to "queue" if given, otherwise to the job's
+// queue, and its name is returned in the X-Task-Name header. With fail=true
+// the transaction fails after enqueueing and neither the category nor the
+// task exists afterwards, which /jobs?task=<name> confirms.
+func CreateWithFollowUp(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	if err := r.ParseForm(); err != nil {
+		panic(err)
+	}
+
+	// Queries other than ancestor queries can't run in a transaction.
+	parent := findByName(ctx, r.Form.Get("parent"))
+
+	var category Category
+	err := transaction.Run(ctx, transaction.Options{Name: "category-followup", XG: true}, func(ctx context.Context) error {
+		category = Category{
+			Name:      r.Form.Get("name"),
+			Ancestors: getAncestorPath(parent),
+			Version:   1,
+		}
+		setTranslations(&category, r.Form)
+		key, err := categoryRepository.Put(ctx, categoryRepository.NewIncompleteKey(ctx, nil), &category)
+		if err != nil {
+			return err
+		}
+
+		task, err := CategoryCreatedJob.NewTask(&CategoryCreatedPayload{Key: key.Encode()})
+		if err != nil {
+			return err
+		}
+		if task, err = CategoryCreatedJob.AddToQueue(ctx, task, r.Form.Get("queue")); err != nil {
+			return err
+		}
+		w.Header().Set("X-Task-Name", task.Name)
+
+		if r.Form.Get("fail") == "true" {
+			return transaction.ErrInjectedFailure
+		}
+		return nil
+	})
+	if err == transaction.ErrInjectedFailure {
+		http.Error(w, "Injected failure, rolled back category and task", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header().Set("ETag", etag(&category))
+	if err := json.NewEncoder(w).Encode(category); err != nil {
+		panic(err)
+	}
+}
+
+// categoryCreated runs once the category is committed, so it's always found.
+func categoryCreated(ctx context.Context, info job.Info, p *CategoryCreatedPayload) error {
+	category := findByKey(ctx, p.Key)
+	if category == nil {
+		return fmt.Errorf("category %s not found", p.Key)
+	}
+	log.Infof(ctx, "Category %q was created, followed up by task %s", category.Name, info.TaskName)
+	return nil
+}
@@ -0,0 +1,150 @@
+package categories
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Translation is the name of a category in one locale. Translations are
+// stored as a slice of structs, which datastore flattens into the indexed
+// multi-valued properties Translations.Locale and Translations.Name.
+type Translation struct {
+	Locale string
+	Name   string
+}
+
+// requestedLocales returns the locales the client asked for in order of
+// preference. The "locale" form value, which may be a comma separated list,
+// takes precedence over the Accept-Language header.
+func requestedLocales(r *http.Request) []string {
+	if locale := r.Form.Get("locale"); locale != "" {
+		var locales []string
+		for _, l := range strings.Split(locale, ",") {
+			if l = strings.TrimSpace(l); l != "" {
+				locales = append(locales, l)
+			}
+		}
+		return locales
+	}
+	return parseAcceptLanguage(r.Header.Get("Accept-Language"))
+}
+
+func parseAcceptLanguage(header string) []string {
+	type weighted struct {
+		locale string
+		q      float64
+	}
+
+	var candidates []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		locale := strings.TrimSpace(fields[0])
+		if locale == "" || locale == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if parsed, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, weighted{locale, q})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+
+	locales := make([]string, len(candidates))
+	for i, c := range candidates {
+		locales[i] = c.locale
+	}
+	return locales
+}
+
+// fallbackChain expands each requested locale with its less specific parents,
+// e.g. "sv-SE" is followed by "sv", keeping the client's order of preference.
+func fallbackChain(locales []string) []string {
+	var chain []string
+	seen := map[string]bool{}
+	for _, locale := range locales {
+		tag := strings.ToLower(strings.Replace(locale, "_", "-", -1))
+		for tag != "" {
+			if !seen[tag] {
+				seen[tag] = true
+				chain = append(chain, tag)
+			}
+			if i := strings.LastIndex(tag, "-"); i >= 0 {
+				tag = tag[:i]
+			} else {
+				tag = ""
+			}
+		}
+	}
+	return chain
+}
+
+// localize sets LocalizedName and Locale to the first translation found in
+// the fallback chain, falling back to the untranslated Name.
+func localize(category *Category, chain []string) {
+	category.LocalizedName = category.Name
+	category.Locale = ""
+
+	for _, locale := range chain {
+		for _, t := range category.Translations {
+			if strings.ToLower(t.Locale) == locale {
+				category.LocalizedName = t.Name
+				category.Locale = t.Locale
+				return
+			}
+		}
+	}
+}
+
+func localizeResult(result interface{}, locales []string) {
+	if len(locales) == 0 {
+		return
+	}
+
+	chain := fallbackChain(locales)
+	switch v := result.(type) {
+	case *Category:
+		if v != nil {
+			localize(v, chain)
+		}
+	case []Category:
+		for i := range v {
+			localize(&v[i], chain)
+		}
+	}
+}
+
+// setTranslations applies form values on the form "name.<locale>" to the
+// category. An empty value removes the translation for that locale.
+func setTranslations(category *Category, form url.Values) {
+	for field, values := range form {
+		if !strings.HasPrefix(field, "name.") || len(field) == len("name.") {
+			continue
+		}
+		locale := field[len("name."):]
+		name := values[0]
+
+		translations := []Translation{}
+		for _, t := range category.Translations {
+			if !strings.EqualFold(t.Locale, locale) {
+				translations = append(translations, t)
+			}
+		}
+		if name != "" {
+			translations = append(translations, Translation{Locale: locale, Name: name})
+		}
+		category.Translations = translations
+	}
+}
@@ -0,0 +1,29 @@
+package categories
+
+import (
+	"github.com/gabrielf/datastore-sandbox/src/migration"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func init() {
+	// Categories created before optimistic concurrency was introduced have no
+	// Version and would all share the ETag "0".
+	migration.Register(migration.Migration{
+		ID:   "category-initial-version",
+		Kind: "Category",
+		Migrate: func(ctx context.Context, key *datastore.Key, props *datastore.PropertyList) (bool, error) {
+			for i, p := range *props {
+				if p.Name == "Version" {
+					if version, ok := p.Value.(int64); ok && version > 0 {
+						return false, nil
+					}
+					(*props)[i].Value = int64(1)
+					return true, nil
+				}
+			}
+			*props = append(*props, datastore.Property{Name: "Version", Value: int64(1)})
+			return true, nil
+		},
+	})
+}
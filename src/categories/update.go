@@ -0,0 +1,241 @@
+package categories
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gabrielf/datastore-sandbox/src/job"
+	"github.com/gabrielf/datastore-sandbox/src/transaction"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+var errVersionMismatch = errors.New("category has been modified")
+
+type CategoryMovedPayload struct {
+	Key string
+}
+
+var CategoryMovedJob = job.Register(job.Type{
+	Name:    "category-moved",
+	Path:    "/jobs/category-moved",
+	Handler: moveDescendants,
+})
+
+// Update changes the name, translated names and/or parent of the category
+// identified by the "key" form value. The request must carry an If-Match
+// header with the ETag of the version being edited, otherwise concurrent
+// editors could silently overwrite each other.
+func Update(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	key, err := datastore.DecodeKey(r.Form.Get("key"))
+	if err != nil || key.Kind() != "Category" {
+		http.Error(w, "Missing or invalid key parameter", http.StatusBadRequest)
+		return
+	}
+
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		http.Error(w, "Missing If-Match header", http.StatusPreconditionRequired)
+		return
+	}
+
+	_, moved := r.Form["parent"]
+	var parent *Category
+	if moved {
+		parent = findByName(ctx, r.Form.Get("parent"))
+		if r.Form.Get("parent") != "" && parent == nil {
+			http.Error(w, "Parent not found", http.StatusBadRequest)
+			return
+		}
+		if parent != nil && (parent.Key.Equal(key) || contains(parent.Ancestors, key.Encode())) {
+			http.Error(w, "A category can't be moved below itself", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var category Category
+	err = transaction.Run(ctx, transaction.Options{Name: "category-update"}, func(ctx context.Context) error {
+		category = Category{}
+		if err := categoryRepository.Get(ctx, key, &category); err != nil {
+			return err
+		}
+		if !etagMatches(ifMatch, &category, false) {
+			return errVersionMismatch
+		}
+
+		if name := r.Form.Get("name"); name != "" {
+			category.Name = name
+		}
+		setTranslations(&category, r.Form)
+		if moved {
+			category.Ancestors = getAncestorPath(parent)
+		}
+		category.Version += 1
+
+		if _, err := categoryRepository.Put(ctx, key, &category); err != nil {
+			return err
+		}
+		if moved {
+			_, err := CategoryMovedJob.Enqueue(ctx, &CategoryMovedPayload{Key: key.Encode()})
+			return err
+		}
+		return nil
+	})
+
+	switch err {
+	case nil:
+	case datastore.ErrNoSuchEntity:
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	case errVersionMismatch:
+		w.Header().Set("ETag", etag(&category))
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	default:
+		panic(err)
+	}
+
+	w.Header().Set("ETag", etag(&category))
+	if err := json.NewEncoder(w).Encode(category); err != nil {
+		panic(err)
+	}
+}
+
+// moveDescendants rewrites the ancestor paths of every category below the
+// moved one. Descendants live in their own entity groups so this happens in a
+// task, which is added in the transaction that moved the category itself and
+// is retried until every descendant is moved. The category is read again, so
+// a task that runs after a later move applies the latest path, and
+// descendants that already have it are left alone.
+func moveDescendants(ctx context.Context, info job.Info, p *CategoryMovedPayload) error {
+	movedKey, err := datastore.DecodeKey(p.Key)
+	if err != nil {
+		return err
+	}
+	var moved Category
+	if err := categoryRepository.Get(ctx, movedKey, &moved); err != nil {
+		return err
+	}
+
+	q := categoryRepository.NewQuery().Filter("Ancestors=", p.Key).KeysOnly()
+	descendantKeys, err := categoryRepository.GetAll(ctx, q, nil)
+	if err != nil {
+		return err
+	}
+	for _, descendantKey := range descendantKeys {
+		descendantKey := descendantKey
+		err := transaction.Run(ctx, transaction.Options{Name: "category-move-descendant"}, func(ctx context.Context) error {
+			var category Category
+			if err := categoryRepository.Get(ctx, descendantKey, &category); err != nil {
+				return err
+			}
+			for i, ancestor := range category.Ancestors {
+				if ancestor == p.Key {
+					ancestors := append(getAncestorPath(&moved), category.Ancestors[i+1:]...)
+					if equal(ancestors, category.Ancestors) {
+						return nil
+					}
+					category.Ancestors = ancestors
+					break
+				}
+			}
+			category.Version += 1
+
+			_, err := categoryRepository.Put(ctx, descendantKey, &category)
+			return err
+		})
+		if err == datastore.ErrNoSuchEntity {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeETag sets the ETag header for category, which must be localized
+// already, and answers 304 Not Modified when it matches the request's
+// If-None-Match header. It returns true if the response has been written.
+func writeETag(w http.ResponseWriter, r *http.Request, category *Category) bool {
+	w.Header().Set("ETag", etag(category))
+
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, category, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// etag is the version of category, followed by the locale it was localized
+// to since the body differs between locales, e.g. "3" or "3-sv". A category
+// localized to no locale, falling back to its untranslated name, ends in "-".
+func etag(category *Category) string {
+	tag := strconv.Itoa(category.Version)
+	if category.LocalizedName != "" {
+		tag += "-" + category.Locale
+	}
+	return strconv.Quote(tag)
+}
+
+// etagVersion returns the version part of an ETag returned by etag.
+func etagVersion(tag string) string {
+	tag, err := strconv.Unquote(tag)
+	if err != nil {
+		return ""
+	}
+	return strings.SplitN(tag, "-", 2)[0]
+}
+
+// etagMatches checks a comma separated If-Match/If-None-Match header value
+// against category. If-None-Match compares whole tags weakly, ignoring the W/
+// prefix, so a cached body in another locale doesn't match. If-Match compares
+// strongly so weak tags never match, but only the version, since any locale
+// of the version being edited is as good as another.
+func etagMatches(header string, category *Category, weak bool) bool {
+	current := etag(category)
+	version := strconv.Itoa(category.Version)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if (weak && tag == current) || (!weak && etagVersion(tag) == version) {
+			return true
+		}
+	}
+	return false
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,454 @@
+package categories
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gabrielf/datastore-sandbox/src/repository"
+	"github.com/gabrielf/datastore-sandbox/src/transaction"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+var (
+	versionRepository      = repository.New("CategoryVersion")
+	versionEntryRepository = repository.New("CategoryVersionEntry")
+)
+
+var errVersionExists = errors.New("version already exists")
+
+// Version is an immutable snapshot of the whole category tree. Each category
+// is stored as a versionEntry child of the version, so the size of the tree
+// isn't limited by the size of one entity and it can be read back with a
+// strongly consistent ancestor query. A version is Pending while its entries
+// are written and isn't served until they all are.
+type Version struct {
+	Name          string `datastore:"-"`
+	CreatedAt     time.Time
+	CategoryCount int
+	Pending       bool `json:",omitempty"`
+	// Tree holds the categories as JSON in versions created before they were
+	// stored as entries.
+	Tree []byte `datastore:",noindex" json:"-"`
+}
+
+func (v *Version) SetKey(key *datastore.Key) {
+	v.Name = key.StringID()
+}
+
+// versionEntry is a category as it was in a version, keyed by the encoded key
+// of the category below the version. Category can't be stored as is since its
+// Key isn't saved and would be set to the key of the entry when loaded.
+type versionEntry struct {
+	Category     *datastore.Key `datastore:",noindex"`
+	Ancestors    []string       `datastore:",noindex"`
+	Name         string         `datastore:",noindex"`
+	Translations []Translation  `datastore:",noindex"`
+	Version      int            `datastore:",noindex"`
+}
+
+type VersionDiff struct {
+	From       string
+	To         string
+	Added      []Category
+	Removed    []Category
+	Renamed    []Rename
+	Translated []Translate
+	Moved      []Move
+}
+
+type Rename struct {
+	Key  *datastore.Key
+	From string
+	To   string
+}
+
+// Translate describes a changed translation of a category. From is empty for
+// an added translation and To for a removed one.
+type Translate struct {
+	Key    *datastore.Key
+	Name   string
+	Locale string
+	From   string
+	To     string
+}
+
+// Move describes a category that got a new parent. Parents are given by name
+// as they were in the respective version, the empty string being the top.
+type Move struct {
+	Key        *datastore.Key
+	Name       string
+	FromParent string
+	ToParent   string
+}
+
+func Versions(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		panic(err)
+	}
+
+	if r.Method == "POST" {
+		CreateVersion(w, r)
+	} else {
+		ListVersions(w, r)
+	}
+}
+
+// CreateVersion snapshots the current category tree under the name given by
+// the "name" form value. The name is claimed with a pending version first, so
+// that concurrent requests for the same name get 409 Conflict, and the
+// version is completed once all of its entries are written.
+func CreateVersion(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	name := r.Form.Get("name")
+	if name == "" {
+		http.Error(w, "Missing name parameter", http.StatusBadRequest)
+		return
+	}
+
+	key := versionKey(ctx, name)
+	version := Version{Name: name, CreatedAt: time.Now(), Pending: true}
+	err := transaction.Run(ctx, transaction.Options{Name: "category-version"}, func(ctx context.Context) error {
+		var existing Version
+		if err := versionRepository.Get(ctx, key, &existing); err != datastore.ErrNoSuchEntity {
+			if err == nil {
+				return errVersionExists
+			}
+			return err
+		}
+		_, err := versionRepository.Put(ctx, key, &version)
+		return err
+	})
+	if err == errVersionExists {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	categories, err := snapshotCategories(ctx)
+	if err == nil {
+		err = putVersionEntries(ctx, key, categories)
+	}
+	if err == nil {
+		version.CategoryCount = len(categories)
+		version.Pending = false
+		_, err = versionRepository.Put(ctx, key, &version)
+	}
+	if err != nil {
+		// Give up the name so the version can be created again.
+		deleteVersion(ctx, key)
+		panic(err)
+	}
+
+	if err := json.NewEncoder(w).Encode(version); err != nil {
+		panic(err)
+	}
+}
+
+// snapshotCategories returns all categories. Categories are root entities
+// and can't be read with an ancestor query, so their keys are queried and the
+// categories looked up by key, which is strongly consistent. Categories are
+// thereby as of now even if the index lags behind, though one created or
+// deleted moments ago may still be missing or included by the query.
+func snapshotCategories(ctx context.Context) ([]Category, error) {
+	keys, err := categoryRepository.GetAll(ctx, categoryRepository.NewQuery().KeysOnly(), nil)
+	if err != nil {
+		return nil, err
+	}
+	categories := make([]Category, len(keys))
+	err = categoryRepository.GetMulti(ctx, keys, categories)
+	multiErr, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return nil, err
+	}
+
+	found := []Category{}
+	for i, category := range categories {
+		if ok && multiErr[i] != nil {
+			if multiErr[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			return nil, multiErr[i]
+		}
+		found = append(found, category)
+	}
+	return found, nil
+}
+
+func putVersionEntries(ctx context.Context, versionKey *datastore.Key, categories []Category) error {
+	keys := make([]*datastore.Key, len(categories))
+	entries := make([]versionEntry, len(categories))
+	for i, category := range categories {
+		keys[i] = versionEntryRepository.NewKey(ctx, category.Key.Encode(), 0, versionKey)
+		entries[i] = versionEntry{
+			Category:     category.Key,
+			Ancestors:    category.Ancestors,
+			Name:         category.Name,
+			Translations: category.Translations,
+			Version:      category.Version,
+		}
+	}
+	_, err := versionEntryRepository.PutMulti(ctx, keys, entries)
+	return err
+}
+
+// deleteVersion removes a version that couldn't be completed along with the
+// entries written so far, logging rather than returning failures since the
+// original error is the one worth reporting.
+func deleteVersion(ctx context.Context, key *datastore.Key) {
+	q := versionEntryRepository.NewQuery().Ancestor(key).KeysOnly()
+	keys, err := versionEntryRepository.GetAll(ctx, q, nil)
+	if err == nil {
+		err = versionEntryRepository.DeleteMulti(ctx, keys)
+	}
+	if err == nil {
+		err = versionRepository.Delete(ctx, key)
+	}
+	if err != nil {
+		log.Errorf(ctx, "Couldn't delete incomplete version %s: %s", key.StringID(), err)
+	}
+}
+
+func ListVersions(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	var versions []Version
+	if _, err := versionRepository.GetAll(ctx, versionRepository.NewQuery().Order("-CreatedAt"), &versions); err != nil {
+		panic(err)
+	}
+
+	if err := json.NewEncoder(w).Encode(versions); err != nil {
+		panic(err)
+	}
+}
+
+// DiffVersions compares the versions named by the "from" and "to" form values
+// and reports which categories were added, removed, renamed or moved.
+func DiffVersions(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	from, to := r.FormValue("from"), r.FormValue("to")
+	if from == "" || to == "" {
+		http.Error(w, "Missing from or to parameter", http.StatusBadRequest)
+		return
+	}
+
+	fromTree := loadVersionTree(ctx, from)
+	toTree := loadVersionTree(ctx, to)
+	if fromTree == nil || toTree == nil {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(diffTrees(from, fromTree, to, toTree)); err != nil {
+		panic(err)
+	}
+}
+
+func diffTrees(from string, fromTree []Category, to string, toTree []Category) VersionDiff {
+	diff := VersionDiff{
+		From:       from,
+		To:         to,
+		Added:      []Category{},
+		Removed:    []Category{},
+		Renamed:    []Rename{},
+		Translated: []Translate{},
+		Moved:      []Move{},
+	}
+
+	fromByKey := indexByKey(fromTree)
+	toByKey := indexByKey(toTree)
+
+	for _, category := range fromTree {
+		if _, ok := toByKey[category.Key.Encode()]; !ok {
+			diff.Removed = append(diff.Removed, category)
+		}
+	}
+	for _, category := range toTree {
+		old, ok := fromByKey[category.Key.Encode()]
+		if !ok {
+			diff.Added = append(diff.Added, category)
+			continue
+		}
+		if old.Name != category.Name {
+			diff.Renamed = append(diff.Renamed, Rename{
+				Key:  category.Key,
+				From: old.Name,
+				To:   category.Name,
+			})
+		}
+		diff.Translated = append(diff.Translated, diffTranslations(old, category)...)
+		if parentKey(old) != parentKey(category) {
+			diff.Moved = append(diff.Moved, Move{
+				Key:        category.Key,
+				Name:       category.Name,
+				FromParent: fromByKey[parentKey(old)].Name,
+				ToParent:   toByKey[parentKey(category)].Name,
+			})
+		}
+	}
+
+	return diff
+}
+
+// diffTranslations compares the translations of two versions of a category
+// by locale, reporting them in the order of the newer version followed by
+// the removed ones.
+func diffTranslations(old, category Category) []Translate {
+	var changes []Translate
+	oldByLocale := map[string]string{}
+	for _, t := range old.Translations {
+		oldByLocale[strings.ToLower(t.Locale)] = t.Name
+	}
+	seen := map[string]bool{}
+	for _, t := range category.Translations {
+		locale := strings.ToLower(t.Locale)
+		seen[locale] = true
+		if from := oldByLocale[locale]; from != t.Name {
+			changes = append(changes, Translate{Key: category.Key, Name: category.Name, Locale: t.Locale, From: from, To: t.Name})
+		}
+	}
+	for _, t := range old.Translations {
+		if !seen[strings.ToLower(t.Locale)] {
+			changes = append(changes, Translate{Key: category.Key, Name: category.Name, Locale: t.Locale, From: t.Name})
+		}
+	}
+	return changes
+}
+
+// getPinned serves the same lookups as Get but from the snapshot named by the
+// "version" form value instead of the live categories.
+func getPinned(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	tree := loadVersionTree(ctx, r.Form.Get("version"))
+	if tree == nil {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+
+	var result interface{}
+	if r.Form.Get("key") != "" {
+		category, ok := indexByKey(tree)[r.Form.Get("key")]
+		if !ok {
+			http.Error(w, "Category not found", http.StatusNotFound)
+			return
+		}
+		result = &category
+	} else if r.Form.Get("name") != "" {
+		result = findInTreeByName(tree, r.Form.Get("name"))
+	} else if r.Form.Get("ancestor") != "" {
+		result = findInTreeByAncestor(tree, findInTreeByName(tree, r.Form.Get("ancestor")), false)
+	} else if r.Form.Get("parent") != "" {
+		result = findInTreeByAncestor(tree, findInTreeByName(tree, r.Form.Get("parent")), true)
+	} else {
+		result = tree
+	}
+
+	w.Header().Set("Vary", "Accept-Language")
+	localizeResult(result, requestedLocales(r))
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		panic(err)
+	}
+}
+
+func loadVersionTree(ctx context.Context, name string) []Category {
+	if name == "" {
+		return nil
+	}
+
+	key := versionKey(ctx, name)
+	var version Version
+	if err := versionRepository.Get(ctx, key, &version); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		panic(err)
+	}
+	if version.Pending {
+		return nil
+	}
+
+	tree := []Category{}
+	if len(version.Tree) > 0 {
+		if err := json.Unmarshal(version.Tree, &tree); err != nil {
+			panic(err)
+		}
+		return tree
+	}
+
+	var entries []versionEntry
+	if _, err := versionEntryRepository.GetAll(ctx, versionEntryRepository.NewQuery().Ancestor(key), &entries); err != nil {
+		panic(err)
+	}
+	for _, entry := range entries {
+		tree = append(tree, Category{
+			Key:          entry.Category,
+			Ancestors:    entry.Ancestors,
+			Name:         entry.Name,
+			Translations: entry.Translations,
+			Version:      entry.Version,
+		})
+	}
+	return tree
+}
+
+func findInTreeByName(tree []Category, name string) *Category {
+	for i, category := range tree {
+		if category.Name == name {
+			return &tree[i]
+		}
+	}
+	for i, category := range tree {
+		for _, t := range category.Translations {
+			if t.Name == name {
+				return &tree[i]
+			}
+		}
+	}
+	return nil
+}
+
+func findInTreeByAncestor(tree []Category, ancestor *Category, directChildrenOnly bool) []Category {
+	categories := []Category{}
+	if ancestor == nil {
+		return categories
+	}
+
+	ancestorKey := ancestor.Key.Encode()
+	for _, category := range tree {
+		if directChildrenOnly && parentKey(category) == ancestorKey {
+			categories = append(categories, category)
+		} else if !directChildrenOnly && contains(category.Ancestors, ancestorKey) {
+			categories = append(categories, category)
+		}
+	}
+	return categories
+}
+
+func indexByKey(tree []Category) map[string]Category {
+	index := make(map[string]Category, len(tree))
+	for _, category := range tree {
+		index[category.Key.Encode()] = category
+	}
+	return index
+}
+
+func parentKey(category Category) string {
+	if len(category.Ancestors) == 0 {
+		return ""
+	}
+	return category.Ancestors[len(category.Ancestors)-1]
+}
+
+func versionKey(ctx context.Context, name string) *datastore.Key {
+	return versionRepository.NewKey(ctx, name, 0, nil)
+}
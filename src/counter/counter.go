@@ -0,0 +1,314 @@
+package counter
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gabrielf/datastore-sandbox/src/repository"
+	"github.com/gabrielf/datastore-sandbox/src/transaction"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+const (
+	defaultShards   = 20
+	maxShards       = 1000
+	cacheExpiration = time.Minute
+)
+
+var (
+	configRepository = repository.New("CounterConfig")
+	shardRepository  = repository.New("CounterShard")
+	countersMu       sync.Mutex
+	counters         = map[string]*Counter{}
+)
+
+// Shards are picked at random, and the source isn't seeded by default, so
+// every instance would pick the same sequence of shards.
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// Counter is a count spread over a number of shards, each in its own entity
+// group, so that increments don't all contend for one entity.
+type Counter struct {
+	Name string
+	// Shards is the number of shards used until more are added with
+	// EnsureShards.
+	Shards int
+}
+
+type config struct {
+	Shards int
+}
+
+type shard struct {
+	Name  string
+	Count int64
+}
+
+// New returns the counter with the given name, creating and registering it
+// the first time so that it can be inspected through the HTTP handlers.
+func New(name string, shards int) *Counter {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+
+	if c, ok := counters[name]; ok {
+		return c
+	}
+	if shards <= 0 {
+		shards = defaultShards
+	}
+	c := &Counter{Name: name, Shards: shards}
+	counters[name] = c
+	return c
+}
+
+// Increment adds delta to a random shard in a transaction of its own. If the
+// shard is contended the counter grows and the increment is retried on a
+// shard from the larger set.
+func (c *Counter) Increment(ctx context.Context, delta int64) error {
+	shards, err := c.shardCount(ctx)
+	if err != nil {
+		return err
+	}
+
+	opts := transaction.Options{Name: "counter-increment"}
+	err = transaction.Run(ctx, opts, func(ctx context.Context) error {
+		return c.incrementShard(ctx, rand.Intn(shards), delta)
+	})
+	if terr, ok := err.(*transaction.Error); ok && terr.Reason == transaction.ReasonContention && shards < maxShards {
+		log.Infof(ctx, "Counter %s is contended at %d shards, growing", c.Name, shards)
+		if shards, err = c.EnsureShards(ctx, shards*2); err != nil {
+			return err
+		}
+		err = transaction.Run(ctx, opts, func(ctx context.Context) error {
+			return c.incrementShard(ctx, rand.Intn(shards), delta)
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	c.Committed(ctx, delta)
+	return nil
+}
+
+// IncrementInTransaction adds delta to a random shard as part of the
+// transaction ctx belongs to, which must be a cross-group transaction since
+// the shard lives in its own entity group. The shard count is read from
+// memcache only, so no extra entity group is pulled into the transaction.
+// Call Committed once the transaction has committed.
+func (c *Counter) IncrementInTransaction(ctx context.Context, delta int64) error {
+	return c.IncrementShardInTransaction(ctx, c.PickShard(ctx), delta)
+}
+
+// PickShard returns the key of a random shard the way IncrementInTransaction
+// does, for transactions that need to know their entity groups up front.
+// Pass it to IncrementShardInTransaction.
+func (c *Counter) PickShard(ctx context.Context) *datastore.Key {
+	shards := c.Shards
+	if item, err := memcache.Get(ctx, c.shardsCacheKey()); err == nil {
+		if n, err := strconv.Atoi(string(item.Value)); err == nil {
+			shards = n
+		}
+	}
+	return c.shardKey(ctx, rand.Intn(shards))
+}
+
+// IncrementShardInTransaction is IncrementInTransaction for a shard returned
+// by PickShard.
+func (c *Counter) IncrementShardInTransaction(ctx context.Context, key *datastore.Key, delta int64) error {
+	return c.incrementShardKey(ctx, key, delta)
+}
+
+// Committed updates the cached count after an increment has been committed.
+// If the count isn't cached it will be summed from the shards on next read.
+// Memcache can't decrement below zero, so a negative delta drops the cached
+// count instead.
+func (c *Counter) Committed(ctx context.Context, delta int64) {
+	if delta < 0 {
+		if err := memcache.Delete(ctx, c.countCacheKey()); err != nil && err != memcache.ErrCacheMiss {
+			log.Warningf(ctx, "Couldn't drop cached count of %s: %s", c.Name, err)
+		}
+		return
+	}
+	if _, err := memcache.IncrementExisting(ctx, c.countCacheKey(), delta); err != nil && err != memcache.ErrCacheMiss {
+		log.Warningf(ctx, "Couldn't update cached count of %s, dropping it: %s", c.Name, err)
+		memcache.Delete(ctx, c.countCacheKey())
+	}
+}
+
+// Count returns the sum of all shards, cached in memcache.
+func (c *Counter) Count(ctx context.Context) (int64, error) {
+	if item, err := memcache.Get(ctx, c.countCacheKey()); err == nil {
+		if count, err := strconv.ParseInt(string(item.Value), 10, 64); err == nil {
+			return count, nil
+		}
+	}
+
+	shards, err := c.shardCount(ctx)
+	if err != nil {
+		return 0, err
+	}
+	keys := make([]*datastore.Key, shards)
+	for i := range keys {
+		keys[i] = c.shardKey(ctx, i)
+	}
+	values := make([]shard, shards)
+	if err := shardRepository.GetMulti(ctx, keys, values); err != nil {
+		if multiErr, ok := err.(appengine.MultiError); ok {
+			for _, err := range multiErr {
+				if err != nil && err != datastore.ErrNoSuchEntity {
+					return 0, err
+				}
+			}
+		} else {
+			return 0, err
+		}
+	}
+
+	var count int64
+	for _, s := range values {
+		count += s.Count
+	}
+
+	memcache.Add(ctx, &memcache.Item{
+		Key:        c.countCacheKey(),
+		Value:      []byte(strconv.FormatInt(count, 10)),
+		Expiration: cacheExpiration,
+	})
+	return count, nil
+}
+
+// EnsureShards grows the counter to at least n shards. Shards are never
+// removed since their counts would be lost.
+func (c *Counter) EnsureShards(ctx context.Context, n int) (int, error) {
+	if n > maxShards {
+		n = maxShards
+	}
+
+	var cfg config
+	key := configRepository.NewKey(ctx, c.Name, 0, nil)
+	err := transaction.Run(ctx, transaction.Options{Name: "counter-shards"}, func(ctx context.Context) error {
+		cfg = config{Shards: c.Shards}
+		if err := configRepository.Get(ctx, key, &cfg); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if cfg.Shards >= n {
+			return nil
+		}
+		cfg.Shards = n
+		_, err := configRepository.Put(ctx, key, &cfg)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	memcache.Set(ctx, &memcache.Item{
+		Key:   c.shardsCacheKey(),
+		Value: []byte(strconv.Itoa(cfg.Shards)),
+	})
+	return cfg.Shards, nil
+}
+
+func (c *Counter) shardCount(ctx context.Context) (int, error) {
+	if item, err := memcache.Get(ctx, c.shardsCacheKey()); err == nil {
+		if n, err := strconv.Atoi(string(item.Value)); err == nil {
+			return n, nil
+		}
+	}
+
+	cfg := config{Shards: c.Shards}
+	if err := configRepository.Get(ctx, configRepository.NewKey(ctx, c.Name, 0, nil), &cfg); err != nil && err != datastore.ErrNoSuchEntity {
+		return 0, err
+	}
+
+	memcache.Set(ctx, &memcache.Item{
+		Key:   c.shardsCacheKey(),
+		Value: []byte(strconv.Itoa(cfg.Shards)),
+	})
+	return cfg.Shards, nil
+}
+
+func (c *Counter) incrementShard(ctx context.Context, index int, delta int64) error {
+	return c.incrementShardKey(ctx, c.shardKey(ctx, index), delta)
+}
+
+func (c *Counter) incrementShardKey(ctx context.Context, key *datastore.Key, delta int64) error {
+	s := shard{Name: c.Name}
+	if err := shardRepository.Get(ctx, key, &s); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	s.Count += delta
+	_, err := shardRepository.Put(ctx, key, &s)
+	return err
+}
+
+func (c *Counter) shardKey(ctx context.Context, index int) *datastore.Key {
+	return shardRepository.NewKey(ctx, fmt.Sprintf("%s-%d", c.Name, index), 0, nil)
+}
+
+func (c *Counter) countCacheKey() string {
+	return "counter-count:" + c.Name
+}
+
+func (c *Counter) shardsCacheKey() string {
+	return "counter-shards:" + c.Name
+}
+
+// Show returns the count and shard count of the counter given by the "name"
+// form value. POSTing a "shards" form value grows the counter.
+func Show(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	countersMu.Lock()
+	c, ok := counters[r.FormValue("name")]
+	countersMu.Unlock()
+	if !ok {
+		http.Error(w, "Unknown counter", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "POST" {
+		n, err := strconv.Atoi(r.FormValue("shards"))
+		if err != nil {
+			http.Error(w, "Invalid shards parameter", http.StatusBadRequest)
+			return
+		}
+		if _, err := c.EnsureShards(ctx, n); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	shards, err := c.shardCount(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	count, err := c.Count(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := struct {
+		Name   string
+		Shards int
+		Count  int64
+	}{c.Name, shards, count}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
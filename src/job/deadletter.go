@@ -0,0 +1,174 @@
+package job
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gabrielf/datastore-sandbox/src/repository"
+	"github.com/gabrielf/datastore-sandbox/src/transaction"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// DeadLetter is a job that failed MaxAttempts times, kept so it can be
+// inspected and replayed or discarded. It's keyed by the name of the task.
+type DeadLetter struct {
+	TaskName  string `datastore:"-"`
+	Type      string
+	Queue     string
+	Payload   []byte `datastore:",noindex"`
+	Attempts  int
+	Errors    []string `datastore:",noindex"`
+	CreatedAt time.Time
+	FailedAt  time.Time
+}
+
+func (d *DeadLetter) SetKey(key *datastore.Key) {
+	d.TaskName = key.StringID()
+}
+
+var deadLetterRepository = repository.New("JobDeadLetter")
+
+type deadLettersPage struct {
+	DeadLetters []DeadLetter
+	Cursor      string `json:",omitempty"`
+}
+
+// exhausted tells if the attempt described by info is the last one allowed.
+func (t *Type) exhausted(info Info) bool {
+	return t.MaxAttempts > 0 && info.RetryCount+1 >= t.MaxAttempts
+}
+
+// deadLetter saves the payload and error history of a job that won't be
+// retried and marks its record as dead, in one transaction. A missing record,
+// which failing to save it on every attempt leads to, is created so the job
+// is still dead-lettered rather than retried forever.
+func deadLetter(ctx context.Context, t *Type, info Info, payload []byte) error {
+	recordKey := recordRepository.NewKey(ctx, info.TaskName, 0, nil)
+	deadLetterKey := deadLetterRepository.NewKey(ctx, info.TaskName, 0, nil)
+	return transaction.Run(ctx, transaction.Options{Name: "job-dead-letter", XG: true}, func(ctx context.Context) error {
+		var record Record
+		if err := recordRepository.Get(ctx, recordKey, &record); err == datastore.ErrNoSuchEntity {
+			record = Record{Type: t.Name, Queue: info.QueueName, Attempts: info.RetryCount + 1, CreatedAt: time.Now()}
+		} else if err != nil {
+			return err
+		}
+		record.State = StateDead
+		record.UpdatedAt = time.Now()
+		record.FinishedAt = record.UpdatedAt
+		if _, err := recordRepository.Put(ctx, recordKey, &record); err != nil {
+			return err
+		}
+
+		letter := DeadLetter{
+			Type:      t.Name,
+			Queue:     info.QueueName,
+			Payload:   payload,
+			Attempts:  record.Attempts,
+			Errors:    record.Errors,
+			CreatedAt: record.CreatedAt,
+			FailedAt:  record.UpdatedAt,
+		}
+		_, err := deadLetterRepository.Put(ctx, deadLetterKey, &letter)
+		return err
+	})
+}
+
+// DeadLetters lists dead-lettered jobs newest first, optionally only of
+// "type", or shows the one of the task given by "task". POST with "task" and
+// action=replay enqueues the job again with the same payload, and
+// action=discard deletes it.
+func DeadLetters(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	name := r.FormValue("task")
+	if r.Method == "POST" {
+		if name == "" {
+			http.Error(w, "Missing task parameter", http.StatusBadRequest)
+			return
+		}
+		switch r.FormValue("action") {
+		case "replay":
+			replayDeadLetter(ctx, w, name)
+		case "discard":
+			if err := deadLetterRepository.Delete(ctx, deadLetterRepository.NewKey(ctx, name, 0, nil)); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			log.Infof(ctx, "Discarded dead-lettered task %s", name)
+		default:
+			http.Error(w, "Action must be replay or discard", http.StatusBadRequest)
+		}
+		return
+	}
+
+	if name != "" {
+		var letter DeadLetter
+		if err := deadLetterRepository.Get(ctx, deadLetterRepository.NewKey(ctx, name, 0, nil), &letter); err == datastore.ErrNoSuchEntity {
+			http.Error(w, "No such dead letter", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, letter)
+		return
+	}
+
+	q := deadLetterRepository.NewQuery()
+	if typ := r.FormValue("type"); typ != "" {
+		q = q.Filter("Type =", typ)
+	}
+	q = q.Order("-FailedAt")
+
+	page := deadLettersPage{DeadLetters: []DeadLetter{}}
+	var err error
+	if _, page.Cursor, err = deadLetterRepository.Page(ctx, q, r.FormValue("cursor"), defaultPageSize, &page.DeadLetters); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, page)
+}
+
+// replayDeadLetter adds a new task with the payload of a dead letter to the
+// queue the job failed on and deletes the dead letter, in one transaction so
+// a job isn't replayed twice.
+func replayDeadLetter(ctx context.Context, w http.ResponseWriter, name string) {
+	key := deadLetterRepository.NewKey(ctx, name, 0, nil)
+
+	var added string
+	err := transaction.Run(ctx, transaction.Options{Name: "job-replay", XG: true}, func(ctx context.Context) error {
+		var letter DeadLetter
+		if err := deadLetterRepository.Get(ctx, key, &letter); err != nil {
+			return err
+		}
+		t, ok := Lookup(letter.Type)
+		if !ok {
+			return errUnknownType
+		}
+
+		task, err := t.AddToQueue(ctx, t.newTask(letter.Payload), letter.Queue)
+		if err != nil {
+			return err
+		}
+		added = task.Name
+		return deadLetterRepository.Delete(ctx, key)
+	})
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "No such dead letter", http.StatusNotFound)
+		return
+	}
+	if err == errUnknownType {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof(ctx, "Replayed dead-lettered task %s as %s", name, added)
+	writeJSON(w, map[string]string{"TaskName": added})
+}
@@ -0,0 +1,299 @@
+package job
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime/debug"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+// Info describes the task a job is run by, taken from the X-AppEngine-*
+// headers that only the task queue can set.
+type Info struct {
+	Type           string
+	TaskName       string
+	QueueName      string
+	RetryCount     int
+	ExecutionCount int
+	Header         http.Header
+}
+
+// Type is a kind of job. Handler must be a function of the form
+//
+//	func(ctx context.Context, info job.Info, payload *P) error
+//
+// where P is the payload struct, which is sent as JSON in the task body.
+// Returning an error fails the task so that it's retried, unless it has been
+// attempted MaxAttempts times in which case it's moved to the dead letters.
+// Without MaxAttempts the retry options of the queue apply.
+type Type struct {
+	Name        string
+	Path        string
+	Queue       string
+	MaxAttempts int
+	Handler     interface{}
+
+	payloadType reflect.Type
+	handler     reflect.Value
+}
+
+var (
+	typesMu sync.Mutex
+	types   = map[string]*Type{}
+)
+
+// Limits on the number of tasks added at once.
+const (
+	MaxAddBatch           = 100
+	MaxTransactionalTasks = 5
+)
+
+var errUnknownType = errors.New("job: unknown job type")
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	infoType    = reflect.TypeOf(Info{})
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Register validates the handler of a job type and makes it known by name.
+// It panics on invalid handlers, so call it when initializing a package.
+// The returned type serves its tasks and needs to be routed at its Path.
+func Register(t Type) *Type {
+	if t.Name == "" || t.Path == "" {
+		panic("job: Register called without name or path")
+	}
+
+	v := reflect.ValueOf(t.Handler)
+	ft := v.Type()
+	if ft.Kind() != reflect.Func || ft.NumIn() != 3 || ft.NumOut() != 1 ||
+		ft.In(0) != contextType || ft.In(1) != infoType ||
+		ft.In(2).Kind() != reflect.Ptr || ft.In(2).Elem().Kind() != reflect.Struct ||
+		ft.Out(0) != errorType {
+		panic(fmt.Sprintf("job: handler of %s must be func(context.Context, job.Info, *Payload) error, got %s", t.Name, ft))
+	}
+	t.payloadType = ft.In(2).Elem()
+	t.handler = v
+
+	typesMu.Lock()
+	defer typesMu.Unlock()
+	if _, ok := types[t.Name]; ok {
+		panic("job: Register called twice for " + t.Name)
+	}
+	types[t.Name] = &t
+	return &t
+}
+
+// Lookup returns the registered job type with the given name.
+func Lookup(name string) (*Type, bool) {
+	typesMu.Lock()
+	defer typesMu.Unlock()
+	t, ok := types[name]
+	return t, ok
+}
+
+// NewTask creates the task for a job without adding it, to allow setting
+// options like ETA or RetryOptions first.
+func (t *Type) NewTask(payload interface{}) (*taskqueue.Task, error) {
+	if reflect.TypeOf(payload) != reflect.PtrTo(t.payloadType) && reflect.TypeOf(payload) != t.payloadType {
+		return nil, fmt.Errorf("job: payload of %s must be %s, got %T", t.Name, t.payloadType, payload)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return t.newTask(body), nil
+}
+
+func (t *Type) newTask(body []byte) *taskqueue.Task {
+	return &taskqueue.Task{
+		Path:    t.Path,
+		Payload: body,
+		Header:  http.Header{"Content-Type": {"application/json"}},
+		Method:  "POST",
+	}
+}
+
+// Enqueue adds a task running the job with payload to the job's queue and
+// records it as queued.
+func (t *Type) Enqueue(ctx context.Context, payload interface{}) (*taskqueue.Task, error) {
+	task, err := t.NewTask(payload)
+	if err != nil {
+		return nil, err
+	}
+	return t.Add(ctx, task)
+}
+
+// Add adds a task created by NewTask to the job's queue and records it as
+// queued. To add the task in a transaction, start the transaction with
+// transaction.Run so that the record is saved in it too.
+func (t *Type) Add(ctx context.Context, task *taskqueue.Task) (*taskqueue.Task, error) {
+	return t.AddToQueue(ctx, task, t.Queue)
+}
+
+// AddToQueue is like Add but adds the task to another queue than the job's,
+// for example one with different retry parameters. Failing to record the task
+// is only logged since the first attempt creates the record as well.
+func (t *Type) AddToQueue(ctx context.Context, task *taskqueue.Task, queue string) (*taskqueue.Task, error) {
+	if queue == "" {
+		queue = t.Queue
+	}
+	added, err := taskqueue.Add(ctx, task, queue)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordEnqueued(ctx, t, queue, added.Name); err != nil {
+		log.Errorf(ctx, "Failed to record %s task %s: %s", t.Name, added.Name, err)
+	}
+	return added, nil
+}
+
+// AddMulti adds tasks created by NewTask to queue, or the job's queue if
+// empty, in batches of MaxAddBatch and records them as queued, with one write
+// per batch. Tasks that failed to be added are reported in an
+// appengine.MultiError with the error at the same index, and the
+// corresponding added task is nil. In a transaction at most
+// MaxTransactionalTasks can be added.
+func (t *Type) AddMulti(ctx context.Context, tasks []*taskqueue.Task, queue string) ([]*taskqueue.Task, error) {
+	if queue == "" {
+		queue = t.Queue
+	}
+
+	added := make([]*taskqueue.Task, len(tasks))
+	var multiErr appengine.MultiError
+	for lo := 0; lo < len(tasks); lo += MaxAddBatch {
+		hi := lo + MaxAddBatch
+		if hi > len(tasks) {
+			hi = len(tasks)
+		}
+
+		batch, err := taskqueue.AddMulti(ctx, tasks[lo:hi], queue)
+		batchErr, isMultiErr := err.(appengine.MultiError)
+		if err != nil && !isMultiErr {
+			return added, err
+		}
+		var names []string
+		for i := lo; i < hi; i++ {
+			if isMultiErr && batchErr[i-lo] != nil {
+				if multiErr == nil {
+					multiErr = make(appengine.MultiError, len(tasks))
+				}
+				multiErr[i] = batchErr[i-lo]
+				continue
+			}
+			added[i] = batch[i-lo]
+			names = append(names, added[i].Name)
+		}
+		if err := recordEnqueuedMulti(ctx, t, queue, names); err != nil {
+			log.Errorf(ctx, "Failed to record %d %s tasks, their first attempts will: %s", len(names), t.Name, err)
+		}
+	}
+	if multiErr != nil {
+		return added, multiErr
+	}
+	return added, nil
+}
+
+// TaskName derives the name of the task running a job on queue, or the job's
+// queue if empty, from an idempotency key, so that adding the task again for
+// the same key fails with taskqueue.ErrTaskAlreadyAdded instead of running
+// the job twice. The queue is part of the name so the same key can be used on
+// several queues. Names stay taken for a while even after the task has run,
+// see /experiments/tombstone.
+func (t *Type) TaskName(queue, idempotencyKey string) string {
+	if queue == "" {
+		queue = t.Queue
+	}
+	sum := sha256.Sum256([]byte(queue + "\x00" + idempotencyKey))
+	return t.Name + "-" + hex.EncodeToString(sum[:])
+}
+
+// ServeHTTP decodes the payload of a task and runs the handler.
+func (t *Type) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	info, ok := ParseInfo(r)
+	if !ok {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	info.Type = t.Name
+
+	payload := reflect.New(t.payloadType)
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(r.Body); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if body.Len() > 0 {
+		if err := json.Unmarshal(body.Bytes(), payload.Interface()); err != nil {
+			// Retrying won't make the payload any more valid so the
+			// task is acknowledged.
+			log.Errorf(ctx, "Dropping %s task %s with invalid payload: %s", t.Name, info.TaskName, err)
+			return
+		}
+	}
+
+	recordAttempt(ctx, t, info, false, nil)
+	err := t.call(ctx, info, payload)
+	recordAttempt(ctx, t, info, true, err)
+	if err != nil {
+		log.Warningf(ctx, "%s task %s failed on retry %d: %s", t.Name, info.TaskName, info.RetryCount, err)
+		if t.exhausted(info) {
+			// Acknowledge the task once its dead letter is saved,
+			// otherwise let it be retried to try saving it again.
+			if err := deadLetter(ctx, t, info, body.Bytes()); err != nil {
+				log.Errorf(ctx, "Failed to dead-letter %s task %s: %s", t.Name, info.TaskName, err)
+			} else {
+				log.Errorf(ctx, "Dead-lettered %s task %s after %d attempts", t.Name, info.TaskName, info.RetryCount+1)
+				return
+			}
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// call runs the handler with payload. A panicking handler fails the attempt
+// like an error would, so it's recorded, retried and eventually dead-lettered
+// instead of leaving the record running.
+func (t *Type) call(ctx context.Context, info Info, payload reflect.Value) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Errorf(ctx, "%s task %s panicked: %v\n%s", t.Name, info.TaskName, p, debug.Stack())
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	out := t.handler.Call([]reflect.Value{reflect.ValueOf(ctx), reflect.ValueOf(info), payload})
+	err, _ = out[0].Interface().(error)
+	return err
+}
+
+// ParseInfo reads the task queue headers of r. It returns false if r wasn't
+// made by the task queue.
+func ParseInfo(r *http.Request) (Info, bool) {
+	info := Info{
+		TaskName:  r.Header.Get("X-AppEngine-TaskName"),
+		QueueName: r.Header.Get("X-AppEngine-QueueName"),
+		Header:    r.Header,
+	}
+	if info.TaskName == "" {
+		return info, false
+	}
+	info.RetryCount, _ = strconv.Atoi(r.Header.Get("X-AppEngine-TaskRetryCount"))
+	info.ExecutionCount, _ = strconv.Atoi(r.Header.Get("X-AppEngine-TaskExecutionCount"))
+	return info, true
+}
@@ -0,0 +1,229 @@
+package job
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gabrielf/datastore-sandbox/src/repository"
+	"github.com/gabrielf/datastore-sandbox/src/transaction"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	StateQueued   = "queued"
+	StateRunning  = "running"
+	StateRetrying = "retrying"
+	StateDone     = "done"
+	StateDead     = "dead"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 500
+	maxErrors       = 10
+)
+
+// Record tracks a job through its attempts. It's keyed by task name and
+// created when the job is enqueued, or by the first attempt if that happens
+// to run before the enqueuing request has saved it.
+type Record struct {
+	TaskName   string `datastore:"-"`
+	Type       string
+	Queue      string
+	State      string
+	Attempts   int
+	LastError  string   `datastore:",noindex"`
+	Errors     []string `datastore:",noindex"`
+	CreatedAt  time.Time
+	StartedAt  time.Time
+	UpdatedAt  time.Time
+	FinishedAt time.Time
+}
+
+func (r *Record) SetKey(key *datastore.Key) {
+	r.TaskName = key.StringID()
+}
+
+var recordRepository = repository.New("Job")
+
+type recordsPage struct {
+	Jobs   []Record
+	Cursor string `json:",omitempty"`
+}
+
+// Status shows the record of the job run by the task given by "task", or
+// lists job records newest first, optionally filtered by "queue", "state"
+// and "type". Pass the returned cursor as "cursor" to get the next page.
+func Status(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	if name := r.FormValue("task"); name != "" {
+		record, err := Get(ctx, name)
+		if err == datastore.ErrNoSuchEntity {
+			http.Error(w, "No such job", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, record)
+		return
+	}
+
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	q := recordRepository.NewQuery()
+	for _, filter := range []string{"Queue", "State", "Type"} {
+		if value := r.FormValue(strings.ToLower(filter)); value != "" {
+			q = q.Filter(filter+" =", value)
+		}
+	}
+	q = q.Order("-CreatedAt")
+
+	page := recordsPage{Jobs: []Record{}}
+	if _, page.Cursor, err = recordRepository.Page(ctx, q, r.FormValue("cursor"), limit, &page.Jobs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, page)
+}
+
+// Get returns the record of the job run by the named task.
+func Get(ctx context.Context, task string) (*Record, error) {
+	var record Record
+	if err := recordRepository.Get(ctx, recordRepository.NewKey(ctx, task, 0, nil), &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// recordEnqueued saves the record of a newly added task unless its first
+// attempt already has. When the task is added in a transaction the record is
+// saved in it as well, so it's only saved if the task is added.
+func recordEnqueued(ctx context.Context, t *Type, queue, task string) error {
+	return updateRecord(ctx, task, func(record *Record, found bool) {
+		if !found {
+			*record = Record{Type: t.Name, Queue: queue, State: StateQueued, CreatedAt: time.Now()}
+		}
+	})
+}
+
+// recordEnqueuedMulti is recordEnqueued for many tasks at once. Outside of a
+// transaction the records are read and saved with one call each instead of
+// one transaction per task, so a record created by an attempt that started
+// in between may be reset to queued, which the attempt's next update fixes.
+func recordEnqueuedMulti(ctx context.Context, t *Type, queue string, tasks []string) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+	if transaction.InTransaction(ctx) {
+		for _, task := range tasks {
+			if err := recordEnqueued(ctx, t, queue, task); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	keys := make([]*datastore.Key, len(tasks))
+	for i, task := range tasks {
+		keys[i] = recordRepository.NewKey(ctx, task, 0, nil)
+	}
+	existing := make([]Record, len(keys))
+	err := recordRepository.GetMulti(ctx, keys, existing)
+	multiErr, isMultiErr := err.(appengine.MultiError)
+	if err != nil && !isMultiErr {
+		return err
+	}
+
+	now := time.Now()
+	var missingKeys []*datastore.Key
+	var records []Record
+	for i, key := range keys {
+		if err == nil || multiErr[i] == nil {
+			continue
+		}
+		if multiErr[i] != datastore.ErrNoSuchEntity {
+			return multiErr[i]
+		}
+		missingKeys = append(missingKeys, key)
+		records = append(records, Record{Type: t.Name, Queue: queue, State: StateQueued, CreatedAt: now, UpdatedAt: now})
+	}
+	if len(missingKeys) == 0 {
+		return nil
+	}
+	_, err = recordRepository.PutMulti(ctx, missingKeys, records)
+	return err
+}
+
+// recordAttempt updates the record when an attempt starts, and when it
+// finishes with err.
+func recordAttempt(ctx context.Context, t *Type, info Info, finished bool, err error) {
+	now := time.Now()
+	updateErr := updateRecord(ctx, info.TaskName, func(record *Record, found bool) {
+		if !found {
+			*record = Record{Type: t.Name, Queue: info.QueueName, CreatedAt: now}
+		}
+		record.Attempts = info.RetryCount + 1
+		switch {
+		case !finished:
+			record.State = StateRunning
+			record.StartedAt = now
+		case err != nil:
+			record.State = StateRetrying
+			record.LastError = err.Error()
+			record.Errors = append(record.Errors, fmt.Sprintf("attempt %d: %s", record.Attempts, err))
+			if len(record.Errors) > maxErrors {
+				record.Errors = record.Errors[len(record.Errors)-maxErrors:]
+			}
+		default:
+			record.State = StateDone
+			record.FinishedAt = now
+		}
+	})
+	if updateErr != nil {
+		log.Errorf(ctx, "Failed to update record of %s task %s: %s", t.Name, info.TaskName, updateErr)
+	}
+}
+
+// updateRecord reads, updates and saves a record in a transaction, or in the
+// transaction ctx already belongs to.
+func updateRecord(ctx context.Context, task string, update func(record *Record, found bool)) error {
+	key := recordRepository.NewKey(ctx, task, 0, nil)
+	f := func(ctx context.Context) error {
+		var record Record
+		err := recordRepository.Get(ctx, key, &record)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		update(&record, err == nil)
+		record.UpdatedAt = time.Now()
+		_, err = recordRepository.Put(ctx, key, &record)
+		return err
+	}
+	if transaction.InTransaction(ctx) {
+		return f(ctx)
+	}
+	return transaction.Run(ctx, transaction.Options{Name: "job-record"}, f)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
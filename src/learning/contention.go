@@ -0,0 +1,191 @@
+package learning
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gabrielf/datastore-sandbox/src/counter"
+	"github.com/gabrielf/datastore-sandbox/src/trace"
+	"github.com/go-errors/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	maxContentionRequests = 200
+	maxContentionAttempts = 10
+)
+
+var contentionCounter = counter.New("contention-benchmark", 20)
+
+type ContentionReport struct {
+	Requests    int
+	MaxAttempts int
+	Single      *VariantReport `json:",omitempty"`
+	Sharded     *VariantReport `json:",omitempty"`
+}
+
+type VariantReport struct {
+	Committed                   int
+	Failed                      int
+	Retries                     int
+	ConcurrentTransactionErrors int
+	Duration                    time.Duration
+	Latency                     LatencyStats
+	Errors                      []string `json:",omitempty"`
+}
+
+// LatencyStats are in milliseconds and measured from the first attempt until
+// the transaction committed.
+type LatencyStats struct {
+	Min  float64
+	Mean float64
+	P50  float64
+	P95  float64
+	Max  float64
+}
+
+type attemptResult struct {
+	latency          time.Duration
+	attempts         int
+	concurrentErrors int
+	err              error
+}
+
+// BenchmarkContention fires "n" concurrent transactions at one entity group
+// and, unless variant is "single", the same number of increments at a
+// sharded counter for comparison. Every transaction is attempted at most
+// "attempts" times with retries done here so they can be counted.
+func BenchmarkContention(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	n, err := strconv.Atoi(r.FormValue("n"))
+	if err != nil || n <= 0 {
+		n = 10
+	}
+	if n > maxContentionRequests {
+		n = maxContentionRequests
+	}
+	attempts, err := strconv.Atoi(r.FormValue("attempts"))
+	if err != nil || attempts <= 0 {
+		attempts = 3
+	}
+	if attempts > maxContentionAttempts {
+		attempts = maxContentionAttempts
+	}
+	variant := r.FormValue("variant")
+
+	report := ContentionReport{Requests: n, MaxAttempts: attempts}
+	if variant != "sharded" {
+		report.Single = runContended(ctx, n, attempts, incrementBenchmarkRoot)
+	}
+	if variant != "single" {
+		report.Sharded = runContended(ctx, n, attempts, func(ctx context.Context) error {
+			return contentionCounter.IncrementInTransaction(ctx, 1)
+		})
+		contentionCounter.Committed(ctx, int64(report.Sharded.Committed))
+	}
+
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		http.Error(w, errors.Wrap(err, 0).ErrorStack(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// incrementBenchmarkRoot does what CreateLogEntryInTransaction did before
+// the log entry count was sharded and entries were moved out of the root's
+// entity group, on a root of its own.
+func incrementBenchmarkRoot(ctx context.Context) error {
+	rootKey := rootRepository.NewKey(ctx, "contention-benchmark", 0, nil)
+	var root Root
+	if err := rootRepository.Get(ctx, rootKey, &root); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	root.LogEntries += 1
+
+	logEntry := RootLog{Root: rootKey.StringID(), UpdatedAt: time.Now()}
+	if _, err := rootLogRepository.Put(ctx, rootLogRepository.NewIncompleteKey(ctx, rootKey), &logEntry); err != nil {
+		return err
+	}
+	_, err := rootRepository.Put(ctx, rootKey, &root)
+	return err
+}
+
+func runContended(ctx context.Context, n, maxAttempts int, f func(ctx context.Context) error) *VariantReport {
+	results := make([]attemptResult, n)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = runAttempts(ctx, maxAttempts, f)
+		}(i)
+	}
+	wg.Wait()
+
+	report := &VariantReport{Duration: time.Since(start)}
+	var latencies []time.Duration
+	for _, result := range results {
+		report.Retries += result.attempts - 1
+		report.ConcurrentTransactionErrors += result.concurrentErrors
+		if result.err != nil {
+			report.Failed += 1
+			report.Errors = append(report.Errors, result.err.Error())
+			continue
+		}
+		report.Committed += 1
+		latencies = append(latencies, result.latency)
+	}
+	report.Latency = latencyStats(latencies)
+	return report
+}
+
+func runAttempts(ctx context.Context, maxAttempts int, f func(ctx context.Context) error) attemptResult {
+	var result attemptResult
+	start := time.Now()
+	for result.attempts < maxAttempts {
+		result.attempts += 1
+		done := trace.Start(ctx, "", "transaction")
+		result.err = datastore.RunInTransaction(ctx, f, &datastore.TransactionOptions{Attempts: 1})
+		done(0, result.err)
+		if result.err != datastore.ErrConcurrentTransaction {
+			break
+		}
+		result.concurrentErrors += 1
+	}
+	result.latency = time.Since(start)
+	return result
+}
+
+func latencyStats(latencies []time.Duration) LatencyStats {
+	if len(latencies) == 0 {
+		return LatencyStats{}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	percentile := func(p int) float64 {
+		return ms(latencies[(len(latencies)-1)*p/100])
+	}
+
+	var total time.Duration
+	for _, l := range latencies {
+		total += l
+	}
+	return LatencyStats{
+		Min:  ms(latencies[0]),
+		Mean: ms(total) / float64(len(latencies)),
+		P50:  percentile(50),
+		P95:  percentile(95),
+		Max:  ms(latencies[len(latencies)-1]),
+	}
+}
@@ -0,0 +1,234 @@
+package learning
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gabrielf/datastore-sandbox/src/trace"
+	"github.com/gabrielf/datastore-sandbox/src/transaction"
+	"github.com/go-errors/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	defaultPageSize     = 20
+	maxPageSize         = 500
+	defaultRetention    = 30 * 24 * time.Hour
+	retentionBatchSize  = 20
+	retentionTimeBudget = 5 * time.Minute
+)
+
+var retentionFunc *delay.Function
+
+func init() {
+	retentionFunc = delay.Func("log-retention", deleteOldLogEntries)
+}
+
+type logEntriesPage struct {
+	Entries []RootLog
+	Cursor  string `json:",omitempty"`
+}
+
+// ListLogEntries returns the log entries newest first, "limit" at a time.
+// Entries are in entity groups of their own so they are listed with an
+// eventually consistent query, and a just written entry may be missing.
+// Pass the returned cursor as "cursor" to get the next page and "from" and
+// "to" as RFC3339 times to only get entries within that range.
+func ListLogEntries(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	name, err := rootName(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := rootLogRepository.NewQuery().Filter("Root =", name).Order("-UpdatedAt")
+	if from := r.FormValue("from"); from != "" {
+		t, err := time.Parse(time.RFC3339Nano, from)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q = q.Filter("UpdatedAt >=", t)
+	}
+	if to := r.FormValue("to"); to != "" {
+		t, err := time.Parse(time.RFC3339Nano, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q = q.Filter("UpdatedAt <", t)
+	}
+
+	page := logEntriesPage{Entries: []RootLog{}}
+	if _, page.Cursor, err = rootLogRepository.Page(ctx, q, r.FormValue("cursor"), limit, &page.Entries); err != nil {
+		http.Error(w, errors.Wrap(err, 0).ErrorStack(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		http.Error(w, errors.Wrap(err, 0).ErrorStack(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// LogRetention is run by cron and deletes log entries of all roots older than
+// "maxAge", the LOG_RETENTION environment variable or 30 days, in that order.
+// A maxAge that isn't positive would delete every entry and is rejected, a
+// LOG_RETENTION like that is ignored.
+func LogRetention(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	maxAge := defaultRetention
+	if value := os.Getenv("LOG_RETENTION"); value != "" {
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			log.Warningf(ctx, "Ignoring invalid LOG_RETENTION %q", value)
+		} else {
+			maxAge = d
+		}
+	}
+	if value := r.FormValue("maxAge"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			http.Error(w, errors.Wrap(err, 0).ErrorStack(), http.StatusBadRequest)
+			return
+		}
+		if d <= 0 {
+			http.Error(w, "maxAge must be positive", http.StatusBadRequest)
+			return
+		}
+		maxAge = d
+	}
+
+	rootKeys, err := rootRepository.GetAll(ctx, rootRepository.NewQuery().KeysOnly(), nil)
+	if err != nil {
+		http.Error(w, errors.Wrap(err, 0).ErrorStack(), http.StatusInternalServerError)
+		return
+	}
+	before := time.Now().Add(-maxAge)
+	for _, rootKey := range rootKeys {
+		if err := retentionFunc.Call(ctx, rootKey.StringID(), before); err != nil {
+			http.Error(w, errors.Wrap(err, 0).ErrorStack(), http.StatusInternalServerError)
+			return
+		}
+	}
+	log.Infof(ctx, "Deleting log entries older than %s of %d roots", maxAge, len(rootKeys))
+}
+
+// deleteOldLogEntries deletes the entries in batches small enough for a
+// cross-group transaction, each together with decrementing the count on the
+// root and the log entry counter. Entries are found with an eventually
+// consistent query, so the transaction checks that they still exist and
+// belong to the root, and it stops when a batch turns out to be deleted
+// already. When running out of time it continues in a new task.
+func deleteOldLogEntries(ctx context.Context, name string, before time.Time) error {
+	defer trace.Begin(ctx, "log-retention")()
+
+	rootKey := rootRepository.NewKey(ctx, name, 0, nil)
+	start := time.Now()
+
+	deleted := 0
+	for {
+		if time.Since(start) > retentionTimeBudget {
+			log.Infof(ctx, "Deleted %d log entries, continuing in a new task", deleted)
+			return retentionFunc.Call(ctx, name, before)
+		}
+
+		q := rootLogRepository.NewQuery().
+			Filter("Root =", name).
+			Filter("UpdatedAt <", before).
+			Limit(retentionBatchSize).
+			KeysOnly()
+		keys, err := rootLogRepository.GetAll(ctx, q, nil)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			break
+		}
+
+		var batch, sharded int
+		err = transaction.Run(ctx, transaction.Options{Name: "log-retention", XG: true}, func(ctx context.Context) error {
+			entries := make([]RootLog, len(keys))
+			err := rootLogRepository.GetMulti(ctx, keys, entries)
+			multiErr, isMultiErr := err.(appengine.MultiError)
+			if err != nil && !isMultiErr {
+				return err
+			}
+			var existing []*datastore.Key
+			for i, key := range keys {
+				if isMultiErr && multiErr[i] != nil {
+					if multiErr[i] != datastore.ErrNoSuchEntity {
+						return multiErr[i]
+					}
+					continue
+				}
+				if entries[i].Root == name && entries[i].UpdatedAt.Before(before) {
+					existing = append(existing, key)
+				}
+			}
+			batch = len(existing)
+			if batch == 0 {
+				return nil
+			}
+			if err := rootLogRepository.DeleteMulti(ctx, existing); err != nil {
+				return err
+			}
+
+			// The oldest entries may predate the counter and be counted on the
+			// root instead, so those are taken off the root first.
+			var root Root
+			if err := rootRepository.Get(ctx, rootKey, &root); err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			sharded = batch
+			if root.LogEntries > 0 {
+				legacy := root.LogEntries
+				if legacy > batch {
+					legacy = batch
+				}
+				root.LogEntries -= legacy
+				if _, err := rootRepository.Put(ctx, rootKey, &root); err != nil {
+					return err
+				}
+				sharded -= legacy
+			}
+			if sharded == 0 {
+				return nil
+			}
+			return logEntriesCounter(name).IncrementInTransaction(ctx, -int64(sharded))
+		})
+		if err != nil {
+			return err
+		}
+		if batch == 0 {
+			break
+		}
+		if sharded > 0 {
+			logEntriesCounter(name).Committed(ctx, -int64(sharded))
+		}
+		deleted += batch
+	}
+
+	log.Infof(ctx, "Deleted %d log entries of %s older than %s", deleted, name, before)
+	return nil
+}
+
+func (l *RootLog) SetKey(key *datastore.Key) {
+	l.Key = key
+}
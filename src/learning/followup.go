@@ -0,0 +1,58 @@
+package learning
+
+import (
+	"net/http"
+
+	"github.com/gabrielf/datastore-sandbox/src/job"
+	"github.com/gabrielf/datastore-sandbox/src/transaction"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+type LogEntryAddedPayload struct {
+	Root     string
+	LogEntry string
+}
+
+var LogEntryAddedJob = job.Register(job.Type{
+	Name:    "log-entry-added",
+	Path:    "/jobs/log-entry-added",
+	Queue:   "slow-queue",
+	Handler: logEntryAdded,
+})
+
+// CreateLogEntryWithFollowUp adds a log entry like /logtrans and enqueues a
+// follow-up task in the same transaction, so the task is only added if the
+// entry is. The task is added to "queue" if given, otherwise to the job's
+// queue, and its name is returned in the X-Task-Name header. With fail=true the transaction fails after enqueueing and the count of log
+// entries stays the same and the task is never run, which /jobs?task=<name>
+// confirms.
+func CreateLogEntryWithFollowUp(w http.ResponseWriter, r *http.Request) {
+	createLogEntryInTransaction(w, r, "log-followup", func(ctx context.Context, name string, logEntryKey *datastore.Key) error {
+		task, err := LogEntryAddedJob.NewTask(&LogEntryAddedPayload{Root: name, LogEntry: logEntryKey.Encode()})
+		if err != nil {
+			return err
+		}
+		if task, err = LogEntryAddedJob.AddToQueue(ctx, task, r.FormValue("queue")); err != nil {
+			return err
+		}
+		w.Header().Set("X-Task-Name", task.Name)
+
+		if r.FormValue("fail") == "true" {
+			return transaction.ErrInjectedFailure
+		}
+		return nil
+	})
+}
+
+// logEntryAdded runs once the log entry is committed and logs the count of
+// log entries it's included in.
+func logEntryAdded(ctx context.Context, info job.Info, p *LogEntryAddedPayload) error {
+	count, err := logEntriesCounter(p.Root).Count(ctx)
+	if err != nil {
+		return err
+	}
+	log.Infof(ctx, "Log entry %s added to %s with %d sharded entries, followed up by task %s", p.LogEntry, p.Root, count, info.TaskName)
+	return nil
+}
@@ -1,17 +1,30 @@
 package learning
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"runtime"
+	"strings"
 	"time"
 
+	"github.com/gabrielf/datastore-sandbox/src/repository"
+	"github.com/gabrielf/datastore-sandbox/src/transaction"
 	"github.com/go-errors/errors"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
+)
+
+// maxPayloadSize keeps log entries well below the entity size limit.
+const maxPayloadSize = 64 * 1024
+
+var (
+	rootRepository    = repository.New("Root")
+	rootLogRepository = repository.New("RootLog")
 )
 
 func Meta(w http.ResponseWriter, r *http.Request) {
@@ -47,17 +60,30 @@ func Echo(w http.ResponseWriter, r *http.Request) {
 func CreateLogEntry(w http.ResponseWriter, r *http.Request) {
 	ctx := appengine.NewContext(r)
 
-	rootKey, _, err := getRootEntity(ctx)
+	logEntry, err := newLogEntry(ctx, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name, err := rootName(r)
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, _, err := getRootEntity(ctx, name); err != nil {
 		http.Error(w, errors.Wrap(err, 0).ErrorStack(), http.StatusInternalServerError)
 		return
 	}
 
-	logEntry := RootLog{
-		UpdatedAt: time.Now(),
+	logEntry.Root = name
+	if _, err = rootLogRepository.Put(ctx, rootLogRepository.NewIncompleteKey(ctx, nil), &logEntry); err != nil {
+		http.Error(w, errors.Wrap(err, 0).ErrorStack(), http.StatusInternalServerError)
+		return
 	}
-	logEntryKey := datastore.NewIncompleteKey(ctx, "RootLog", rootKey)
-	if _, err = datastore.Put(ctx, logEntryKey, &logEntry); err != nil {
+	// Not transactional, unlike CreateLogEntryInTransaction, so the count
+	// drifts if this fails after the entry was written.
+	if err = logEntriesCounter(name).Increment(ctx, 1); err != nil {
 		http.Error(w, errors.Wrap(err, 0).ErrorStack(), http.StatusInternalServerError)
 		return
 	}
@@ -69,34 +95,77 @@ func CreateLogEntry(w http.ResponseWriter, r *http.Request) {
 }
 
 func CreateLogEntryInTransaction(w http.ResponseWriter, r *http.Request) {
+	createLogEntryInTransaction(w, r, "logtrans", nil)
+}
+
+// createLogEntryInTransaction adds a log entry and counts it in a transaction
+// named name. If inTransaction isn't nil it's called with the key of the new
+// entry as part of the transaction, failing it if it returns an error.
+func createLogEntryInTransaction(w http.ResponseWriter, r *http.Request, txName string, inTransaction func(ctx context.Context, name string, logEntryKey *datastore.Key) error) {
 	ctx := appengine.NewContext(r)
 	var outerRoot *Root
 
-	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
-		rootKey, root, err := getRootEntity(ctx)
+	name, err := rootName(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logEntry, err := newLogEntry(ctx, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The log entry and the counter shard are in entity groups of their own,
+	// so writes to a root aren't limited by the write rate of one entity
+	// group, and the root itself is only written when it's created. That
+	// needs a cross-group transaction, pass xg=false to see it fail without.
+	// Clients retrying a request send the same Idempotency-Key to not log
+	// twice.
+	opts := transactionOptions(r, txName, true)
+	opts.IdempotencyKey = r.Header.Get("Idempotency-Key")
+	opts.Scope = name
+	err = transaction.Run(ctx, opts, func(ctx context.Context) error {
+		_, root, err := getRootEntity(ctx, name)
 		if err != nil {
 			return errors.Wrap(err, 0)
 		}
 
-		logEntry := RootLog{
-			UpdatedAt: time.Now(),
-		}
-		logEntryKey := datastore.NewIncompleteKey(ctx, "RootLog", rootKey)
-		root.LogEntries += 1
-
-		if _, err = datastore.Put(ctx, logEntryKey, &logEntry); err != nil {
+		logEntry.Root = name
+		logEntryKey, err := rootLogRepository.Put(ctx, rootLogRepository.NewIncompleteKey(ctx, nil), &logEntry)
+		if err != nil {
 			return errors.New(err)
 		}
-		if _, err = datastore.Put(ctx, rootKey, root); err != nil {
+		if err = logEntriesCounter(name).IncrementInTransaction(ctx, 1); err != nil {
 			return errors.New(err)
 		}
+		if inTransaction != nil {
+			if err := inTransaction(ctx, name, logEntryKey); err != nil {
+				return err
+			}
+		}
 
 		outerRoot = root
 		return nil
-	}, &datastore.TransactionOptions{XG: false})
+	})
 
-	if err != nil {
-		log.Errorf(ctx, errors.Wrap(err, 0).ErrorStack())
+	if err == transaction.ErrInjectedFailure {
+		http.Error(w, "Injected failure, rolled back log entry", http.StatusInternalServerError)
+		return
+	}
+	if err == transaction.ErrAlreadyApplied {
+		if _, outerRoot, err = getRootEntity(ctx, name); err != nil {
+			http.Error(w, errors.Wrap(err, 0).ErrorStack(), http.StatusInternalServerError)
+			return
+		}
+	} else if err != nil {
+		http.Error(w, errors.Wrap(err, 0).ErrorStack(), http.StatusInternalServerError)
+		return
+	} else {
+		logEntriesCounter(name).Committed(ctx, 1)
+	}
+
+	if err := loadLogEntries(ctx, name, outerRoot); err != nil {
 		http.Error(w, errors.Wrap(err, 0).ErrorStack(), http.StatusInternalServerError)
 		return
 	}
@@ -107,12 +176,43 @@ func CreateLogEntryInTransaction(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func getRootEntity(ctx context.Context) (*datastore.Key, *Root, error) {
+// newLogEntry creates a log entry with the request's JSON body, if any, as
+// payload together with the same request metadata that Meta prints.
+func newLogEntry(ctx context.Context, r *http.Request) (RootLog, error) {
+	logEntry := RootLog{
+		UpdatedAt:  time.Now(),
+		RequestID:  appengine.RequestID(ctx),
+		InstanceID: appengine.InstanceID(),
+		Module:     appengine.ModuleName(ctx),
+		Version:    appengine.VersionID(ctx),
+	}
+
+	if r.Body == nil || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		return logEntry, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxPayloadSize+1))
+	if err != nil {
+		return RootLog{}, err
+	}
+	if len(body) > maxPayloadSize {
+		return RootLog{}, fmt.Errorf("payload is larger than %d bytes", maxPayloadSize)
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return logEntry, nil
+	}
+	if !json.Valid(body) {
+		return RootLog{}, errors.New("payload is not valid JSON")
+	}
+	logEntry.Payload = body
+	return logEntry, nil
+}
+
+func getRootEntity(ctx context.Context, name string) (*datastore.Key, *Root, error) {
 	root := Root{}
-	key := datastore.NewKey(ctx, "Root", "root", 0, nil)
-	if err := datastore.Get(ctx, key, &root); err != nil {
+	key := rootRepository.NewKey(ctx, name, 0, nil)
+	if err := rootRepository.Get(ctx, key, &root); err != nil {
 		if err == datastore.ErrNoSuchEntity {
-			key, err = datastore.Put(ctx, key, &root)
+			key, err = rootRepository.Put(ctx, key, &root)
 			if err != nil {
 				return nil, nil, errors.New(err)
 			}
@@ -124,10 +224,32 @@ func getRootEntity(ctx context.Context) (*datastore.Key, *Root, error) {
 	return key, &root, nil
 }
 
+// loadLogEntries adds the sharded count to the LogEntries stored on root,
+// which holds the count from before it was sharded and is only written to
+// take deleted entries off it.
+func loadLogEntries(ctx context.Context, name string, root *Root) error {
+	count, err := logEntriesCounter(name).Count(ctx)
+	if err != nil {
+		return errors.New(err)
+	}
+	root.LogEntries += int(count)
+	return nil
+}
+
 type Root struct {
 	LogEntries int
 }
 
+// RootLog is an audit trail entry of which instance wrote what. Entries are
+// in entity groups of their own and belong to the root named by Root. Those
+// written before were children of their root and still are.
 type RootLog struct {
-	UpdatedAt time.Time
+	Key        *datastore.Key `datastore:"-" json:",omitempty"`
+	Root       string
+	UpdatedAt  time.Time
+	Payload    json.RawMessage `datastore:",noindex" json:",omitempty"`
+	RequestID  string          `json:",omitempty"`
+	InstanceID string          `json:",omitempty"`
+	Module     string          `json:",omitempty"`
+	Version    string          `json:",omitempty"`
 }
@@ -0,0 +1,28 @@
+package learning
+
+import (
+	"github.com/gabrielf/datastore-sandbox/src/migration"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func init() {
+	// Log entries written while they were children of their root have no
+	// Root property and aren't found by the queries on it.
+	migration.Register(migration.Migration{
+		ID:   "root-log-root-property",
+		Kind: "RootLog",
+		Migrate: func(ctx context.Context, key *datastore.Key, props *datastore.PropertyList) (bool, error) {
+			for _, p := range *props {
+				if p.Name == "Root" {
+					return false, nil
+				}
+			}
+			if key.Parent() == nil {
+				return false, nil
+			}
+			*props = append(*props, datastore.Property{Name: "Root", Value: key.Parent().StringID()})
+			return true, nil
+		},
+	})
+}
@@ -0,0 +1,121 @@
+package learning
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gabrielf/datastore-sandbox/src/counter"
+	"github.com/go-errors/errors"
+	"google.golang.org/appengine"
+)
+
+const (
+	defaultRootName = "root"
+	rootHeader      = "X-Root"
+	logEntryShards  = 20
+)
+
+var (
+	// Root names become datastore key names and counter names, so they are
+	// limited to what's safe in both. Key names starting with "__" are
+	// reserved by datastore.
+	rootNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+	errInvalidRoot  = errors.New("invalid root name, use up to 64 letters, digits, '_', '.' or '-'")
+
+	defaultLogEntriesCounter = counter.New("log-entries", logEntryShards)
+)
+
+type rootSummary struct {
+	Name       string
+	LogEntries int
+}
+
+// Roots serves the log endpoints for a root chosen by path:
+//
+//	/roots                     lists all roots and their log entry counts
+//	/roots/<name>/log          like /log
+//	/roots/<name>/logtrans     like /logtrans
+//	/roots/<name>/entries      like /log/entries
+//
+// The plain endpoints take the root from the X-Root header instead.
+func Roots(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/roots"), "/")
+	if path == "" {
+		ListRoots(w, r)
+		return
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	if !rootNamePattern.MatchString(parts[0]) {
+		http.Error(w, errInvalidRoot.Error(), http.StatusBadRequest)
+		return
+	}
+	r.Header.Set(rootHeader, parts[0])
+
+	switch parts[1] {
+	case "log":
+		CreateLogEntry(w, r)
+	case "logtrans":
+		CreateLogEntryInTransaction(w, r)
+	case "entries":
+		ListLogEntries(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func ListRoots(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	var roots []Root
+	keys, err := rootRepository.GetAll(ctx, rootRepository.NewQuery(), &roots)
+	if err != nil {
+		http.Error(w, errors.Wrap(err, 0).ErrorStack(), http.StatusInternalServerError)
+		return
+	}
+
+	summaries := []rootSummary{}
+	for i, key := range keys {
+		if err := loadLogEntries(ctx, key.StringID(), &roots[i]); err != nil {
+			http.Error(w, errors.Wrap(err, 0).ErrorStack(), http.StatusInternalServerError)
+			return
+		}
+		summaries = append(summaries, rootSummary{Name: key.StringID(), LogEntries: roots[i].LogEntries})
+	}
+
+	if err := json.NewEncoder(w).Encode(summaries); err != nil {
+		http.Error(w, errors.Wrap(err, 0).ErrorStack(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// rootName returns the name of the root the request is for, which is created
+// on first use, or errInvalidRoot if the name isn't allowed.
+func rootName(r *http.Request) (string, error) {
+	name := r.Header.Get(rootHeader)
+	if name == "" {
+		return defaultRootName, nil
+	}
+	if !rootNamePattern.MatchString(name) {
+		return "", errInvalidRoot
+	}
+	return name, nil
+}
+
+// logEntriesCounter returns the counter of log entries of the named root. The
+// default root keeps the counter name from before there were several roots.
+// Counters of other roots aren't registered with counter.New since clients
+// choose the names, and every name would be kept for the life of the
+// instance.
+func logEntriesCounter(name string) *counter.Counter {
+	if name == defaultRootName {
+		return defaultLogEntriesCounter
+	}
+	return &counter.Counter{Name: "log-entries:" + name, Shards: logEntryShards}
+}
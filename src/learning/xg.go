@@ -0,0 +1,214 @@
+package learning
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gabrielf/datastore-sandbox/src/repository"
+	"github.com/gabrielf/datastore-sandbox/src/transaction"
+	"github.com/go-errors/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+var experimentRepository = repository.New("XGExperiment")
+
+type moveResult struct {
+	Key    *datastore.Key
+	From   string
+	To     string
+	Groups int
+}
+
+type groupsResult struct {
+	Groups int
+}
+
+var errNotInRoot = errors.New("log entry is not in the root")
+
+// MoveLogEntry moves a RootLog from the root named by "from" to the root
+// named by "to" in one transaction, which spans the entity groups of the
+// entry, the "to" root, the log entry counter shards of both roots and the
+// marker of an Idempotency-Key. The entry is given by its encoded "key", or the newest entry of "from" is
+// moved.
+func MoveLogEntry(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	opts := transactionOptions(r, "xg-move", true)
+
+	from, to := formValueOrDefault(r, "from", defaultRootName), r.FormValue("to")
+	toKey := rootRepository.NewKey(ctx, to, 0, nil)
+	if to == "" {
+		http.Error(w, "Missing to parameter", http.StatusBadRequest)
+		return
+	}
+	if !rootNamePattern.MatchString(from) || !rootNamePattern.MatchString(to) {
+		http.Error(w, errInvalidRoot.Error(), http.StatusBadRequest)
+		return
+	}
+	var key *datastore.Key
+	if r.FormValue("key") != "" {
+		var err error
+		if key, err = datastore.DecodeKey(r.FormValue("key")); err != nil || key.Kind() != "RootLog" {
+			http.Error(w, "Invalid key parameter", http.StatusBadRequest)
+			return
+		}
+	} else {
+		// Queries other than ancestor queries can't run in a transaction.
+		q := rootLogRepository.NewQuery().Filter("Root =", from).Order("-UpdatedAt").Limit(1).KeysOnly()
+		keys, err := rootLogRepository.GetAll(ctx, q, nil)
+		if err != nil {
+			http.Error(w, errors.Wrap(err, 0).ErrorStack(), http.StatusInternalServerError)
+			return
+		}
+		if len(keys) == 0 {
+			http.Error(w, "Log entry not found", http.StatusNotFound)
+			return
+		}
+		key = keys[0]
+	}
+
+	// The counter shards and the idempotency marker are entity groups of the
+	// transaction as well, so the shards are picked up front.
+	fromCounter, toCounter := logEntriesCounter(from), logEntriesCounter(to)
+	fromShard, toShard := fromCounter.PickShard(ctx), toCounter.PickShard(ctx)
+	groupKeys := []*datastore.Key{key, toKey, fromShard, toShard, transaction.MarkerKey(ctx, opts)}
+	if err := transaction.CheckGroups(opts, groupKeys...); err != nil {
+		writeTransactionError(w, err)
+		return
+	}
+
+	err := transaction.Run(ctx, opts, func(ctx context.Context) error {
+		var entry RootLog
+		if err := rootLogRepository.Get(ctx, key, &entry); err != nil {
+			return err
+		}
+		if entry.Root != from {
+			return errNotInRoot
+		}
+		var root Root
+		if err := rootRepository.Get(ctx, toKey, &root); err == datastore.ErrNoSuchEntity {
+			if _, err := rootRepository.Put(ctx, toKey, &root); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+
+		entry.Root = to
+		if _, err := rootLogRepository.Put(ctx, key, &entry); err != nil {
+			return err
+		}
+		if err := fromCounter.IncrementShardInTransaction(ctx, fromShard, -1); err != nil {
+			return err
+		}
+		return toCounter.IncrementShardInTransaction(ctx, toShard, 1)
+	})
+	if err == datastore.ErrNoSuchEntity || err == errNotInRoot {
+		http.Error(w, "Log entry not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeTransactionError(w, err)
+		return
+	}
+	fromCounter.Committed(ctx, -1)
+	toCounter.Committed(ctx, 1)
+
+	result := moveResult{Key: key, From: from, To: to, Groups: transaction.EntityGroups(groupKeys...)}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, errors.Wrap(err, 0).ErrorStack(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// TouchEntityGroups writes one entity in each of "n" entity groups in a
+// single transaction to show where the cross-group limit kicks in. Pass
+// precheck=false to let datastore itself reject the transaction. Going past
+// the limit by one is enough to show that, so n is capped there.
+func TouchEntityGroups(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	opts := transactionOptions(r, "xg-groups", true)
+
+	n, err := strconv.Atoi(r.FormValue("n"))
+	if err != nil || n <= 0 {
+		http.Error(w, "Invalid n parameter", http.StatusBadRequest)
+		return
+	}
+	if n > transaction.MaxEntityGroups+1 {
+		n = transaction.MaxEntityGroups + 1
+	}
+
+	keys := make([]*datastore.Key, n)
+	for i := range keys {
+		keys[i] = experimentRepository.NewKey(ctx, fmt.Sprintf("group-%d", i), 0, nil)
+	}
+
+	if r.FormValue("precheck") != "false" {
+		if err := transaction.CheckGroups(opts, keys...); err != nil {
+			writeTransactionError(w, err)
+			return
+		}
+	}
+
+	err = transaction.Run(ctx, opts, func(ctx context.Context) error {
+		for _, key := range keys {
+			entity := RootLog{UpdatedAt: time.Now()}
+			if _, err := experimentRepository.Put(ctx, key, &entity); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeTransactionError(w, err)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(groupsResult{Groups: n}); err != nil {
+		http.Error(w, errors.Wrap(err, 0).ErrorStack(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// transactionOptions reads the "xg" and "attempts" form values.
+func transactionOptions(r *http.Request, name string, xg bool) transaction.Options {
+	opts := transaction.Options{Name: name, XG: xg}
+	if parsed, err := strconv.ParseBool(r.FormValue("xg")); err == nil {
+		opts.XG = parsed
+	}
+	if attempts, err := strconv.Atoi(r.FormValue("attempts")); err == nil && attempts > 0 {
+		opts.Attempts = attempts
+	}
+	return opts
+}
+
+func writeTransactionError(w http.ResponseWriter, err error) {
+	terr, ok := err.(*transaction.Error)
+	if !ok {
+		http.Error(w, errors.Wrap(err, 0).ErrorStack(), http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusInternalServerError
+	switch terr.Reason {
+	case transaction.ReasonContention:
+		status = http.StatusConflict
+	case transaction.ReasonTooManyGroups, transaction.ReasonXGRequired:
+		status = http.StatusBadRequest
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(terr)
+}
+
+func formValueOrDefault(r *http.Request, key, defaultValue string) string {
+	if value := r.FormValue(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,399 @@
+package migration
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gabrielf/datastore-sandbox/src/repository"
+	"github.com/gabrielf/datastore-sandbox/src/trace"
+	"github.com/gabrielf/datastore-sandbox/src/transaction"
+	"github.com/go-errors/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	defaultBatchSize = 100
+	dryRunSuffix     = "/dry-run"
+	// maxConcurrentWrites is the number of entity transactions a batch runs
+	// at once.
+	maxConcurrentWrites = 10
+)
+
+const (
+	StateRunning = "running"
+	StateDone    = "done"
+	StateFailed  = "failed"
+)
+
+// Migration rewrites every entity of Kind. Migrate is called with the raw
+// properties of each entity so it can handle shapes that no longer match any
+// Go struct, and returns true if it changed them and they should be saved.
+//
+// Migrate must be idempotent: a batch whose changes were saved is run again
+// if chaining the next batch fails, and a resumed migration restarts at the
+// last batch that was chained, so entities may be passed to it after they
+// have already been migrated. It's also called twice for the entities it
+// changes, once on the copy read by the query and once more on the copy read
+// in the transaction that saves it, which may run more than once.
+type Migration struct {
+	ID        string
+	Kind      string
+	BatchSize int
+	Migrate   func(ctx context.Context, key *datastore.Key, props *datastore.PropertyList) (bool, error)
+}
+
+// Record tracks the progress of a migration. Dry runs are recorded separately
+// from real runs so they never mark a migration as applied.
+type Record struct {
+	ID         string `datastore:"-"`
+	DryRun     bool
+	State      string
+	Cursor     string `datastore:",noindex"`
+	Batches    int
+	Processed  int
+	Changed    int
+	LastError  string `datastore:",noindex"`
+	StartedAt  time.Time
+	UpdatedAt  time.Time
+	FinishedAt time.Time
+}
+
+func (r *Record) SetKey(key *datastore.Key) {
+	r.ID = strings.TrimSuffix(key.StringID(), dryRunSuffix)
+}
+
+var (
+	migrations       = map[string]Migration{}
+	recordRepository = repository.New("Migration")
+	errAlreadyExists = errors.New("migration has already been started")
+)
+
+// batchFunc is assigned in init since runBatch refers to it when chaining
+// the next batch, which would otherwise be an initialization loop.
+var batchFunc *delay.Function
+
+func init() {
+	batchFunc = delay.Func("migration-batch", runBatch)
+}
+
+// Register makes a migration available to be started. It must be called
+// from init so that the migration is known by every instance executing its
+// batches.
+func Register(m Migration) {
+	if _, ok := migrations[m.ID]; ok {
+		panic("migration: Register called twice for " + m.ID)
+	}
+	if m.BatchSize <= 0 {
+		m.BatchSize = defaultBatchSize
+	}
+	migrations[m.ID] = m
+}
+
+// Index lists all registered migrations with their records, or shows the
+// record of the migration given by the "id" form value.
+func Index(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	if r.Method == "POST" {
+		Start(w, r)
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(r.FormValue("dryRun"))
+	if id := r.FormValue("id"); id != "" {
+		record, err := getRecord(ctx, id, dryRun)
+		if err == datastore.ErrNoSuchEntity {
+			http.Error(w, "Migration has not been started", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, record)
+		return
+	}
+
+	type status struct {
+		ID     string
+		Kind   string
+		Record *Record
+	}
+	statuses := []status{}
+	for _, id := range registeredIDs() {
+		record, err := getRecord(ctx, id, dryRun)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		statuses = append(statuses, status{ID: id, Kind: migrations[id].Kind, Record: record})
+	}
+	writeJSON(w, statuses)
+}
+
+// Start begins the migration given by the "id" form value. With dryRun=true
+// every entity is passed through the migration but nothing is saved.
+func Start(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	m, ok := migrations[r.FormValue("id")]
+	if !ok {
+		http.Error(w, "Unknown migration", http.StatusNotFound)
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.FormValue("dryRun"))
+
+	now := time.Now()
+	record := Record{
+		DryRun:    dryRun,
+		State:     StateRunning,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+	key := recordKey(ctx, m.ID, dryRun)
+	err := transaction.Run(ctx, transaction.Options{Name: "migration-start"}, func(ctx context.Context) error {
+		var existing Record
+		err := recordRepository.Get(ctx, key, &existing)
+		if err == nil && !dryRun {
+			return errAlreadyExists
+		}
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if _, err := recordRepository.Put(ctx, key, &record); err != nil {
+			return err
+		}
+		// Enqueued transactionally so the record never says running
+		// without a task on its way.
+		return batchFunc.Call(ctx, m.ID, dryRun, "")
+	})
+	if err == errAlreadyExists {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, record)
+}
+
+// Resume restarts a failed migration from the cursor of its last completed
+// batch.
+func Resume(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	m, ok := migrations[r.FormValue("id")]
+	if !ok {
+		http.Error(w, "Unknown migration", http.StatusNotFound)
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.FormValue("dryRun"))
+
+	var record Record
+	key := recordKey(ctx, m.ID, dryRun)
+	err := transaction.Run(ctx, transaction.Options{Name: "migration-resume"}, func(ctx context.Context) error {
+		if err := recordRepository.Get(ctx, key, &record); err != nil {
+			return err
+		}
+		if record.State != StateFailed {
+			return fmt.Errorf("migration is %s, only failed migrations can be resumed", record.State)
+		}
+		record.State = StateRunning
+		record.LastError = ""
+		record.UpdatedAt = time.Now()
+		if _, err := recordRepository.Put(ctx, key, &record); err != nil {
+			return err
+		}
+		return batchFunc.Call(ctx, m.ID, dryRun, record.Cursor)
+	})
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "Migration has not been started", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	writeJSON(w, record)
+}
+
+// runBatch migrates one page of entities starting at cursor and then chains
+// the next batch. The record's cursor is only advanced together with
+// enqueueing the next batch, so a retried task for an already completed batch
+// is recognized and skipped.
+func runBatch(ctx context.Context, id string, dryRun bool, cursor string) error {
+	defer trace.Begin(ctx, "migration-batch")()
+
+	m, ok := migrations[id]
+	if !ok {
+		log.Errorf(ctx, "Unknown migration %s, dropping batch", id)
+		return nil
+	}
+	key := recordKey(ctx, id, dryRun)
+
+	var record Record
+	if err := recordRepository.Get(ctx, key, &record); err != nil {
+		return err
+	}
+	if record.State != StateRunning || record.Cursor != cursor {
+		log.Infof(ctx, "Batch at cursor %q of %s already done, skipping", cursor, id)
+		return nil
+	}
+
+	processed, changed, next, err := migrateBatch(ctx, m, dryRun, cursor)
+	if err != nil {
+		log.Errorf(ctx, "Migration %s failed: %s", id, errors.Wrap(err, 0).ErrorStack())
+		return updateRecord(ctx, key, cursor, func(ctx context.Context, record *Record) error {
+			record.State = StateFailed
+			record.LastError = err.Error()
+			return nil
+		})
+	}
+
+	return updateRecord(ctx, key, cursor, func(ctx context.Context, record *Record) error {
+		record.Batches += 1
+		record.Processed += processed
+		record.Changed += changed
+		if next == "" {
+			record.State = StateDone
+			record.FinishedAt = time.Now()
+			return nil
+		}
+		record.Cursor = next
+		return batchFunc.Call(ctx, id, dryRun, next)
+	})
+}
+
+// migrateBatch runs Migrate on a page of entities read with a query. Entities
+// it changes are written each in a transaction of its own that reads the
+// entity again and migrates that, so that a write made to the entity since
+// the query isn't overwritten with the stale copy.
+func migrateBatch(ctx context.Context, m Migration, dryRun bool, cursor string) (processed, changed int, next string, err error) {
+	repo := repository.New(m.Kind)
+	var entities []datastore.PropertyList
+	keys, next, err := repo.Page(ctx, repo.NewQuery(), cursor, m.BatchSize, &entities)
+	if err != nil {
+		return 0, 0, "", err
+	}
+
+	var changedKeys []*datastore.Key
+	for i, key := range keys {
+		didChange, err := m.Migrate(ctx, key, &entities[i])
+		if err != nil {
+			return 0, 0, "", fmt.Errorf("migrating %s: %v", key, err)
+		}
+		if didChange {
+			changedKeys = append(changedKeys, key)
+		}
+	}
+	if dryRun {
+		return len(keys), len(changedKeys), next, nil
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentWrites)
+	errs := make([]error, len(changedKeys))
+	for i, key := range changedKeys {
+		wg.Add(1)
+		go func(i int, key *datastore.Key) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs[i] = migrateEntity(ctx, repo, m, key)
+		}(i, key)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return 0, 0, "", err
+		}
+	}
+	return len(keys), len(changedKeys), next, nil
+}
+
+func migrateEntity(ctx context.Context, repo *repository.Repository, m Migration, key *datastore.Key) error {
+	err := transaction.Run(ctx, transaction.Options{Name: "migration-entity"}, func(ctx context.Context) error {
+		var props datastore.PropertyList
+		if err := repo.Get(ctx, key, &props); err != nil {
+			return err
+		}
+		didChange, err := m.Migrate(ctx, key, &props)
+		if err != nil {
+			return fmt.Errorf("migrating %s: %v", key, err)
+		}
+		if !didChange {
+			return nil
+		}
+		_, err = repo.Put(ctx, key, &props)
+		return err
+	})
+	if err == datastore.ErrNoSuchEntity {
+		// Deleted since the query, there's nothing left to migrate.
+		return nil
+	}
+	return err
+}
+
+// updateRecord applies update to the record in a transaction, which update
+// may use to enqueue tasks, unless another batch has already moved it on.
+func updateRecord(ctx context.Context, key *datastore.Key, cursor string, update func(ctx context.Context, record *Record) error) error {
+	return transaction.Run(ctx, transaction.Options{Name: "migration-batch"}, func(ctx context.Context) error {
+		var record Record
+		if err := recordRepository.Get(ctx, key, &record); err != nil {
+			return err
+		}
+		if record.State != StateRunning || record.Cursor != cursor {
+			return nil
+		}
+		if err := update(ctx, &record); err != nil {
+			return err
+		}
+		record.UpdatedAt = time.Now()
+		_, err := recordRepository.Put(ctx, key, &record)
+		return err
+	})
+}
+
+func getRecord(ctx context.Context, id string, dryRun bool) (*Record, error) {
+	var record Record
+	if err := recordRepository.Get(ctx, recordKey(ctx, id, dryRun), &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func recordKey(ctx context.Context, id string, dryRun bool) *datastore.Key {
+	if dryRun {
+		id += dryRunSuffix
+	}
+	return recordRepository.NewKey(ctx, id, 0, nil)
+}
+
+func registeredIDs() []string {
+	ids := make([]string, 0, len(migrations))
+	for id := range migrations {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
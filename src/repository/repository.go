@@ -0,0 +1,251 @@
+package repository
+
+import (
+	"reflect"
+
+	"github.com/gabrielf/datastore-sandbox/src/trace"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Limits on the number of entities per datastore batch operation.
+const (
+	MaxGetBatch    = 1000
+	MaxPutBatch    = 500
+	MaxDeleteBatch = 500
+)
+
+// Keyed is implemented by entities that want their key populated whenever
+// they are loaded or saved through a Repository.
+type Keyed interface {
+	SetKey(key *datastore.Key)
+}
+
+// Repository wraps the datastore operations for one kind so callers don't
+// have to repeat the kind name or copy keys back into their entities.
+type Repository struct {
+	kind string
+}
+
+func New(kind string) *Repository {
+	return &Repository{kind: kind}
+}
+
+func (r *Repository) Kind() string {
+	return r.kind
+}
+
+func (r *Repository) NewKey(ctx context.Context, stringID string, intID int64, parent *datastore.Key) *datastore.Key {
+	return datastore.NewKey(ctx, r.kind, stringID, intID, parent)
+}
+
+func (r *Repository) NewIncompleteKey(ctx context.Context, parent *datastore.Key) *datastore.Key {
+	return datastore.NewIncompleteKey(ctx, r.kind, parent)
+}
+
+func (r *Repository) NewQuery() *datastore.Query {
+	return datastore.NewQuery(r.kind)
+}
+
+// Get loads the entity stored under key into dst, a struct pointer.
+func (r *Repository) Get(ctx context.Context, key *datastore.Key, dst interface{}) error {
+	done := trace.Start(ctx, r.kind, "get")
+	err := datastore.Get(ctx, key, dst)
+	done(1, err)
+	if err != nil {
+		return err
+	}
+	setKey(reflect.ValueOf(dst), key)
+	return nil
+}
+
+// Put saves src, a struct pointer, and sets its key to the completed key.
+func (r *Repository) Put(ctx context.Context, key *datastore.Key, src interface{}) (*datastore.Key, error) {
+	done := trace.Start(ctx, r.kind, "put")
+	key, err := datastore.Put(ctx, key, src)
+	done(1, err)
+	if err != nil {
+		return nil, err
+	}
+	setKey(reflect.ValueOf(src), key)
+	return key, nil
+}
+
+func (r *Repository) Delete(ctx context.Context, key *datastore.Key) error {
+	done := trace.Start(ctx, r.kind, "delete")
+	err := datastore.Delete(ctx, key)
+	done(1, err)
+	return err
+}
+
+// GetMulti loads the entities stored under keys into dst, a slice of structs
+// or struct pointers, in batches of MaxGetBatch. Errors are returned the same
+// way as by datastore.GetMulti, as an appengine.MultiError with one entry per
+// key if any of the entities couldn't be loaded.
+func (r *Repository) GetMulti(ctx context.Context, keys []*datastore.Key, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	return inBatches(len(keys), MaxGetBatch, func(lo, hi int) error {
+		done := trace.Start(ctx, r.kind, "get-multi")
+		err := datastore.GetMulti(ctx, keys[lo:hi], v.Slice(lo, hi).Interface())
+		done(hi-lo, err)
+		return err
+	}, func(i int) {
+		setKey(v.Index(i), keys[i])
+	})
+}
+
+// PutMulti saves src, a slice of structs or struct pointers, in batches of
+// MaxPutBatch and sets the key of each saved entity.
+func (r *Repository) PutMulti(ctx context.Context, keys []*datastore.Key, src interface{}) ([]*datastore.Key, error) {
+	v := reflect.ValueOf(src)
+	completeKeys := make([]*datastore.Key, len(keys))
+	err := inBatches(len(keys), MaxPutBatch, func(lo, hi int) error {
+		done := trace.Start(ctx, r.kind, "put-multi")
+		batchKeys, err := datastore.PutMulti(ctx, keys[lo:hi], v.Slice(lo, hi).Interface())
+		done(hi-lo, err)
+		copy(completeKeys[lo:hi], batchKeys)
+		return err
+	}, func(i int) {
+		setKey(v.Index(i), completeKeys[i])
+	})
+	return completeKeys, err
+}
+
+// DeleteMulti deletes keys in batches of MaxDeleteBatch.
+func (r *Repository) DeleteMulti(ctx context.Context, keys []*datastore.Key) error {
+	return inBatches(len(keys), MaxDeleteBatch, func(lo, hi int) error {
+		done := trace.Start(ctx, r.kind, "delete-multi")
+		err := datastore.DeleteMulti(ctx, keys[lo:hi])
+		done(hi-lo, err)
+		return err
+	}, func(int) {})
+}
+
+// GetAll runs q and loads all results into dst, a pointer to a slice of
+// structs or struct pointers, setting the key of each entity. dst may be nil
+// for keys only queries.
+func (r *Repository) GetAll(ctx context.Context, q *datastore.Query, dst interface{}) ([]*datastore.Key, error) {
+	done := trace.Start(ctx, r.kind, "query")
+	keys, err := q.GetAll(ctx, dst)
+	done(len(keys), err)
+	if err != nil {
+		return nil, err
+	}
+	if dst != nil {
+		slice := reflect.ValueOf(dst).Elem()
+		for i, key := range keys {
+			setKey(slice.Index(i), key)
+		}
+	}
+	return keys, nil
+}
+
+// Page runs q starting at cursor, which may be empty to start from the
+// beginning, and appends at most limit results to dst, a pointer to a slice
+// of structs or struct pointers. One more result than limit is fetched to
+// tell if there's a next page, and the returned cursor is empty when there
+// isn't. A limit that isn't positive returns no results.
+func (r *Repository) Page(ctx context.Context, q *datastore.Query, cursor string, limit int, dst interface{}) ([]*datastore.Key, string, error) {
+	if limit <= 0 {
+		return nil, "", nil
+	}
+	if cursor != "" {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		q = q.Start(c)
+	}
+
+	slice := reflect.ValueOf(dst).Elem()
+	elemType := slice.Type().Elem()
+	isPtr := elemType.Kind() == reflect.Ptr
+	if isPtr {
+		elemType = elemType.Elem()
+	}
+
+	done := trace.Start(ctx, r.kind, "query")
+	var keys []*datastore.Key
+	it := q.Limit(limit + 1).Run(ctx)
+	for len(keys) < limit {
+		elem := reflect.New(elemType)
+		key, err := it.Next(elem.Interface())
+		if err == datastore.Done {
+			done(len(keys), nil)
+			return keys, "", nil
+		}
+		if err != nil {
+			done(len(keys), err)
+			return nil, "", err
+		}
+		setKey(elem, key)
+		if isPtr {
+			slice.Set(reflect.Append(slice, elem))
+		} else {
+			slice.Set(reflect.Append(slice, elem.Elem()))
+		}
+		keys = append(keys, key)
+	}
+
+	// The cursor is taken before the extra result is read, so the next page
+	// starts with it.
+	next, err := it.Cursor()
+	if err == nil {
+		_, err = it.Next(nil)
+	}
+	if err == datastore.Done {
+		done(len(keys), nil)
+		return keys, "", nil
+	}
+	done(len(keys), err)
+	if err != nil {
+		return nil, "", err
+	}
+	return keys, next.String(), nil
+}
+
+// inBatches calls op for consecutive ranges of at most size of n items. Per
+// item errors are collected into one appengine.MultiError covering all n
+// items and done is called for each item that succeeded.
+func inBatches(n, size int, op func(lo, hi int) error, done func(i int)) error {
+	var multiErr appengine.MultiError
+	for lo := 0; lo < n; lo += size {
+		hi := lo + size
+		if hi > n {
+			hi = n
+		}
+
+		err := op(lo, hi)
+		batchErr, isMultiErr := err.(appengine.MultiError)
+		if err != nil && !isMultiErr {
+			return err
+		}
+		for i := lo; i < hi; i++ {
+			if isMultiErr && batchErr[i-lo] != nil {
+				if multiErr == nil {
+					multiErr = make(appengine.MultiError, n)
+				}
+				multiErr[i] = batchErr[i-lo]
+				continue
+			}
+			done(i)
+		}
+	}
+	if multiErr != nil {
+		return multiErr
+	}
+	return nil
+}
+
+func setKey(v reflect.Value, key *datastore.Key) {
+	if v.Kind() != reflect.Ptr && v.CanAddr() {
+		v = v.Addr()
+	}
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return
+	}
+	if keyed, ok := v.Interface().(Keyed); ok {
+		keyed.SetKey(key)
+	}
+}
@@ -0,0 +1,111 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gabrielf/datastore-sandbox/src/job"
+	"github.com/gabrielf/datastore-sandbox/src/transaction"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/taskqueue"
+)
+
+const maxBatchTasks = 10000
+
+type batchResult struct {
+	Added  int
+	Failed int
+	Tasks  []batchTask
+}
+
+type batchTask struct {
+	Name  string `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+// TriggerBatch enqueues "n" params jobs at once. With transactional=true they
+// are added in a datastore transaction, which is limited to a few tasks and
+// adds either all or none of them. Given an idempotency key task i is named
+// after key/i, so repeating the request shows which tasks already exist.
+func TriggerBatch(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	n, err := strconv.Atoi(r.FormValue("n"))
+	if err != nil || n <= 0 || n > maxBatchTasks {
+		http.Error(w, fmt.Sprintf("n must be between 1 and %d", maxBatchTasks), http.StatusBadRequest)
+		return
+	}
+	transactional := r.FormValue("transactional") == "true"
+	key := idempotencyKey(r)
+	if transactional && n > job.MaxTransactionalTasks {
+		http.Error(w, fmt.Sprintf("At most %d tasks can be added in a transaction", job.MaxTransactionalTasks), http.StatusBadRequest)
+		return
+	}
+	if transactional && key != "" {
+		http.Error(w, "Named tasks can't be added in a transaction", http.StatusBadRequest)
+		return
+	}
+	retry, err := retryOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tasks := make([]*taskqueue.Task, n)
+	for i := range tasks {
+		if tasks[i], err = ParamsJob.NewTask(&ParamsPayload{Name: fmt.Sprintf("batch task %d of %d", i+1, n)}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tasks[i].RetryOptions = retry
+		if key != "" {
+			tasks[i].Name = ParamsJob.TaskName(r.FormValue("queue"), key+"/"+strconv.Itoa(i))
+		}
+	}
+
+	var added []*taskqueue.Task
+	if transactional {
+		err = transaction.Run(ctx, transaction.Options{Name: "batch-add", XG: true}, func(ctx context.Context) error {
+			var err error
+			added, err = ParamsJob.AddMulti(ctx, tasks, r.FormValue("queue"))
+			return err
+		})
+	} else {
+		added, err = ParamsJob.AddMulti(ctx, tasks, r.FormValue("queue"))
+	}
+	multiErr, isMultiErr := err.(appengine.MultiError)
+	if err != nil && !isMultiErr {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A failed transaction is rolled back so none of its tasks are added,
+	// not even those without errors of their own.
+	committed := !transactional || err == nil
+	result := batchResult{Tasks: make([]batchTask, n)}
+	for i := range tasks {
+		switch {
+		case isMultiErr && multiErr[i] != nil:
+			result.Failed += 1
+			result.Tasks[i] = batchTask{Name: tasks[i].Name, Error: multiErr[i].Error()}
+		case !committed:
+			result.Failed += 1
+			result.Tasks[i] = batchTask{Error: "transaction rolled back"}
+		default:
+			result.Added += 1
+			result.Tasks[i] = batchTask{Name: added[i].Name}
+		}
+	}
+
+	if result.Failed > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMultiStatus)
+	}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,69 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gabrielf/datastore-sandbox/src/workflow"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+)
+
+const maxFanOut = 10000
+
+var (
+	fanOutChild = delay.Func("fan-out-child", func(ctx context.Context, c workflow.Child, sleep time.Duration) error {
+		log.Infof(ctx, "Child %d of workflow %s sleeping for %s", c.Index, c.Workflow, sleep)
+		time.Sleep(sleep)
+		return workflow.Complete(ctx, c)
+	})
+	fanOutDone = delay.Func("fan-out-done", func(ctx context.Context, n int, started time.Time) error {
+		log.Infof(ctx, "All %d children done after %s", n, time.Since(started))
+		return nil
+	})
+)
+
+// TriggerFanOut starts a workflow of "n" children sleeping for "sleep" each,
+// counted down over "shards" shards, followed by a task logging how long they
+// took in total. Its progress is shown by /workflows?id=<id>. If starting
+// fails, repeat the request with "id" from the X-Workflow-ID header to resume
+// it.
+func TriggerFanOut(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	n, err := strconv.Atoi(r.FormValue("n"))
+	if err != nil || n < 0 || n > maxFanOut {
+		http.Error(w, fmt.Sprintf("n must be between 0 and %d", maxFanOut), http.StatusBadRequest)
+		return
+	}
+	sleep, err := time.ParseDuration(r.FormValue("sleep"))
+	if err != nil {
+		sleep = time.Second
+	}
+	shards, _ := strconv.Atoi(r.FormValue("shards"))
+
+	args := make([][]interface{}, n)
+	for i := range args {
+		args[i] = []interface{}{sleep}
+	}
+	id := r.FormValue("id")
+	if id == "" {
+		id = "fan-out-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	opts := workflow.Options{Shards: shards, Queue: r.FormValue("queue")}
+	if err := workflow.Start(ctx, id, opts, fanOutChild, args, fanOutDone, n, time.Now()); err != nil {
+		w.Header().Set("X-Workflow-ID", id)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(map[string]string{"ID": id}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
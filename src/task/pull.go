@@ -0,0 +1,173 @@
+package task
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+const (
+	pullQueue          = "pull-queue"
+	defaultLeaseTime   = 60
+	defaultLeaseCount  = 10
+	maxLeaseCount      = 1000
+	pullWorkTimeBudget = 5 * time.Minute
+)
+
+// AddPullTask adds a task with "payload" tagged with "tag" to the pull queue.
+func AddPullTask(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	t := &taskqueue.Task{
+		Method:  "PULL",
+		Payload: []byte(r.FormValue("payload")),
+		Tag:     r.FormValue("tag"),
+	}
+	t, err := taskqueue.Add(ctx, t, pullQueue)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeTasks(w, t)
+}
+
+// LeasePullTasks leases up to "count" tasks for "leaseTime" seconds, only
+// those tagged "tag" if given. With byTag=true and no tag the tasks share the
+// tag of the oldest task.
+func LeasePullTasks(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	count := intFormValue(r, "count", defaultLeaseCount)
+	if count == 0 {
+		count = defaultLeaseCount
+	}
+	if count > maxLeaseCount {
+		count = maxLeaseCount
+	}
+	leaseTime := intFormValue(r, "leaseTime", defaultLeaseTime)
+
+	var tasks []*taskqueue.Task
+	var err error
+	if tag := r.FormValue("tag"); tag != "" || r.FormValue("byTag") == "true" {
+		tasks, err = taskqueue.LeaseByTag(ctx, count, pullQueue, leaseTime, tag)
+	} else {
+		tasks, err = taskqueue.Lease(ctx, count, pullQueue, leaseTime)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeTasks(w, tasks...)
+}
+
+// ModifyPullTaskLease sets the lease of the task "name" to expire in
+// "leaseTime" seconds. The lease is identified by "eta", the ETA of the task
+// as returned when it was leased, and 0 seconds returns the task to the queue.
+func ModifyPullTaskLease(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "Missing name parameter", http.StatusBadRequest)
+		return
+	}
+	eta, err := time.Parse(time.RFC3339Nano, r.FormValue("eta"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t := &taskqueue.Task{Name: name, ETA: eta}
+	if err := taskqueue.ModifyLease(ctx, t, pullQueue, intFormValue(r, "leaseTime", defaultLeaseTime)); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeTasks(w, t)
+}
+
+// DeletePullTask deletes the completed task "name".
+func DeletePullTask(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "Missing name parameter", http.StatusBadRequest)
+		return
+	}
+	if err := taskqueue.Delete(ctx, &taskqueue.Task{Name: name}, pullQueue); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// PullWorker is run by cron and processes the pull queue in batches of tasks
+// with the same tag until it's empty or the time is up. Tasks are deleted
+// once processed and the rest are returned to the queue if the worker fails.
+func PullWorker(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	start := time.Now()
+
+	processed := 0
+	for time.Since(start) < pullWorkTimeBudget {
+		tasks, err := taskqueue.LeaseByTag(ctx, defaultLeaseCount, pullQueue, defaultLeaseTime, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(tasks) == 0 {
+			break
+		}
+
+		if err := processPullTasks(ctx, tasks); err != nil {
+			log.Errorf(ctx, "Failed to process %d pull tasks: %s", len(tasks), err)
+			if err := releaseLeases(ctx, tasks); err != nil {
+				log.Errorf(ctx, "Failed to release leases: %s", err)
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := taskqueue.DeleteMulti(ctx, tasks, pullQueue); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		processed += len(tasks)
+	}
+	log.Infof(ctx, "Processed %d pull tasks in %s", processed, time.Since(start))
+}
+
+func processPullTasks(ctx context.Context, tasks []*taskqueue.Task) error {
+	for _, t := range tasks {
+		log.Infof(ctx, "Processing pull task %s tagged %q leased %d times: %s", t.Name, t.Tag, t.RetryCount, t.Payload)
+	}
+	return nil
+}
+
+func releaseLeases(ctx context.Context, tasks []*taskqueue.Task) error {
+	for _, t := range tasks {
+		if err := taskqueue.ModifyLease(ctx, t, pullQueue, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func intFormValue(r *http.Request, name string, defaultValue int) int {
+	n, err := strconv.Atoi(r.FormValue(name))
+	if err != nil || n < 0 {
+		return defaultValue
+	}
+	return n
+}
+
+func writeTasks(w http.ResponseWriter, tasks ...*taskqueue.Task) {
+	if err := json.NewEncoder(w).Encode(tasks); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
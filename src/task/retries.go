@@ -0,0 +1,71 @@
+package task
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gabrielf/datastore-sandbox/src/job"
+	"github.com/gabrielf/datastore-sandbox/src/repository"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+// Attempt is an observed run of an unstable task. Attempts are children of
+// an UnstableTask key named after the task so they can be queried together.
+type Attempt struct {
+	RetryCount     int
+	ExecutionCount int
+	At             time.Time
+	Delay          time.Duration `datastore:"-"`
+}
+
+var (
+	unstableTaskRepository = repository.New("UnstableTask")
+	attemptRepository      = repository.New("UnstableAttempt")
+)
+
+type retryTimings struct {
+	TaskName string
+	Attempts []Attempt
+}
+
+// RetryTimings shows when each attempt of the unstable task given by "task"
+// ran and how long after the previous one, to compare the backoff actually
+// applied with the retry options of the task and its queue. Start a task to
+// observe with /triggerUnstableTask.
+func RetryTimings(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	name := r.FormValue("task")
+	if name == "" {
+		http.Error(w, "Missing task parameter", http.StatusBadRequest)
+		return
+	}
+
+	timings := retryTimings{TaskName: name, Attempts: []Attempt{}}
+	q := attemptRepository.NewQuery().Ancestor(unstableTaskRepository.NewKey(ctx, name, 0, nil))
+	if _, err := attemptRepository.GetAll(ctx, q, &timings.Attempts); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Sorted here rather than in the query to not need a composite index.
+	sort.Slice(timings.Attempts, func(i, j int) bool { return timings.Attempts[i].At.Before(timings.Attempts[j].At) })
+	for i := 1; i < len(timings.Attempts); i++ {
+		timings.Attempts[i].Delay = timings.Attempts[i].At.Sub(timings.Attempts[i-1].At)
+	}
+
+	if err := json.NewEncoder(w).Encode(timings); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+func recordAttempt(ctx context.Context, info job.Info) error {
+	parent := unstableTaskRepository.NewKey(ctx, info.TaskName, 0, nil)
+	attempt := Attempt{RetryCount: info.RetryCount, ExecutionCount: info.ExecutionCount, At: time.Now()}
+	_, err := attemptRepository.Put(ctx, attemptRepository.NewIncompleteKey(ctx, parent), &attempt)
+	return err
+}
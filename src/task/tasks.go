@@ -2,6 +2,8 @@ package task
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
 	"runtime"
@@ -9,14 +11,20 @@ import (
 	"strings"
 	"time"
 
+	"github.com/gabrielf/datastore-sandbox/src/job"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/delay"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/taskqueue"
 	"google.golang.org/appengine/urlfetch"
 )
 
+// Queues are the names of all queues in queue.yaml, which can't be listed
+// through the API.
+var Queues = []string{"default", "slow-queue", "fast-retry-queue", "backoff-queue", "linear-retry-queue", pullQueue}
+
 var AsyncFunc = delay.Func("do-async-stuff", DoAsyncStuff)
 
 func DoAsyncStuff(ctx context.Context, duration time.Duration, times int) error {
@@ -51,43 +59,71 @@ func DoAsyncStuff(ctx context.Context, duration time.Duration, times int) error
 	return nil
 }
 
-func TriggerSleepTask(w http.ResponseWriter, r *http.Request) {
-	sleepMs := r.FormValue("sleep")
-	times := r.FormValue("times")
+type SleepPayload struct {
+	Sleep time.Duration
+	Times int
+}
+
+type UnstablePayload struct {
+	FailCount int
+}
+
+type ProtectedPayload struct{}
 
-	if sleepMs == "" {
+type ParamsPayload struct {
+	Name string
+}
+
+var (
+	SleepJob = job.Register(job.Type{
+		Name:    "sleep",
+		Path:    "/jobs/sleep",
+		Queue:   "slow-queue",
+		Handler: sleepJob,
+	})
+	UnstableJob = job.Register(job.Type{
+		Name:        "unstable",
+		Path:        "/unstable",
+		Queue:       "slow-queue",
+		MaxAttempts: 5,
+		Handler:     unstableJob,
+	})
+	ProtectedJob = job.Register(job.Type{
+		Name:    "protected",
+		Path:    "/protected",
+		Queue:   "slow-queue",
+		Handler: protectedJob,
+	})
+	ParamsJob = job.Register(job.Type{
+		Name:    "params",
+		Path:    "/params",
+		Queue:   "slow-queue",
+		Handler: paramsJob,
+	})
+)
+
+func TriggerSleepTask(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("sleep") == "" {
 		http.Error(w, "Missing sleep parameter", http.StatusBadRequest)
 		return
 	}
-
-	ctx := appengine.NewContext(r)
-	t := taskqueue.NewPOSTTask("/sleep", map[string][]string{"sleep": {sleepMs}, "times": {times}})
-	createdTask, err := taskqueue.Add(ctx, t, "slow-queue")
+	d, err := time.ParseDuration(r.FormValue("sleep"))
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if err := json.NewEncoder(w).Encode(createdTask); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	times, err := strconv.Atoi(r.FormValue("times"))
+	if err != nil {
+		times = 1
 	}
+
+	enqueue(w, r, SleepJob, &SleepPayload{Sleep: d, Times: times})
 }
 
 func TriggerUnstableTask(w http.ResponseWriter, r *http.Request) {
-	failCount := r.FormValue("failCount")
-
-	ctx := appengine.NewContext(r)
-	t := taskqueue.NewPOSTTask("/unstable", map[string][]string{"failCount": {failCount}})
+	failCount, _ := strconv.Atoi(r.FormValue("failCount"))
 
-	createdTask, err := taskqueue.Add(ctx, t, "slow-queue")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	if err := json.NewEncoder(w).Encode(createdTask); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	enqueue(w, r, UnstableJob, &UnstablePayload{FailCount: failCount})
 }
 
 func TriggerSleepTaskUsingDelay(w http.ResponseWriter, r *http.Request) {
@@ -129,7 +165,15 @@ func Sleep(w http.ResponseWriter, r *http.Request) {
 		times = 1
 	}
 
-	ctx := appengine.NewContext(r)
+	sleep(appengine.NewContext(r), d, times)
+}
+
+func sleepJob(ctx context.Context, _ job.Info, p *SleepPayload) error {
+	sleep(ctx, p.Sleep, p.Times)
+	return nil
+}
+
+func sleep(ctx context.Context, d time.Duration, times int) {
 	for i := 1; i <= times; i++ {
 		log.Infof(ctx, "Round %d of %d", i, times)
 		log.Infof(ctx, "Will sleep for %v", d)
@@ -139,65 +183,75 @@ func Sleep(w http.ResponseWriter, r *http.Request) {
 	log.Infof(ctx, "Slept for %f seconds", d.Seconds()*float64(times))
 }
 
-func Unstable(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-
-	failCount, err := strconv.Atoi(r.FormValue("failCount"))
-	if err != nil {
-		log.Infof(ctx, "Couldn't parse failCount %s setting to 0", r.FormValue("failCount"))
-		failCount = 0
+func unstableJob(ctx context.Context, info job.Info, p *UnstablePayload) error {
+	if err := recordAttempt(ctx, info); err != nil {
+		log.Errorf(ctx, "Failed to record attempt: %s", err)
 	}
-	retryCount, err := strconv.Atoi(r.Header.Get("X-AppEngine-TaskRetryCount"))
 
-	log.Infof(ctx, "failCount: %v", failCount)
-	log.Infof(ctx, "retryCount: %v", retryCount)
+	log.Infof(ctx, "failCount: %v", p.FailCount)
+	log.Infof(ctx, "retryCount: %v", info.RetryCount)
 
 	log.Infof(ctx, "----------------------------")
 	log.Infof(ctx, "Headers")
 
-	for header, values := range r.Header {
+	for header, values := range info.Header {
 		log.Infof(ctx, "%v: %v", header, values)
 	}
 
-	if retryCount < failCount {
+	if info.RetryCount < p.FailCount {
 		log.Infof(ctx, "Failing!")
-		http.Error(w, "Failure", http.StatusInternalServerError)
-	} else {
-		log.Infof(ctx, "Success")
+		return errors.New("Failure")
 	}
+	log.Infof(ctx, "Success")
+	return nil
 }
 
 func TriggerProtectedTask(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-	t := taskqueue.NewPOSTTask("/protected", nil)
+	enqueue(w, r, ProtectedJob, &ProtectedPayload{})
+}
 
-	createdTask, err := taskqueue.Add(ctx, t, "slow-queue")
+// protectedJob is only run for requests from the task queue, which bypass the
+// admin login required for /protected in app.yaml.
+func protectedJob(ctx context.Context, _ job.Info, _ *ProtectedPayload) error {
+	log.Infof(ctx, "Doing secret stuff")
+	return nil
+}
+
+func TriggerParamsTask(w http.ResponseWriter, r *http.Request) {
+	enqueue(w, r, ParamsJob, &ParamsPayload{Name: "John Doe"})
+}
+
+func paramsJob(ctx context.Context, info job.Info, p *ParamsPayload) error {
+	log.Infof(ctx, "Got parameters: %+v", *p)
+	log.Infof(ctx, "Got task %s on queue %s", info.TaskName, info.QueueName)
+	log.Infof(ctx, "Got headers: %+v", info.Header)
+	return nil
+}
+
+// enqueue adds a job and responds with the created task. The queue can be
+// chosen with "queue" and retries configured as parsed by retryOptions. Given
+// an Idempotency-Key header or "idempotencyKey" the task is named after it, and
+// repeating the request responds 409 with the record of the existing job.
+func enqueue(w http.ResponseWriter, r *http.Request, t *job.Type, payload interface{}) {
+	ctx := appengine.NewContext(r)
+	task, err := t.NewTask(payload)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if err := json.NewEncoder(w).Encode(createdTask); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if task.RetryOptions, err = retryOptions(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-}
-
-func Protected(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+	if key := idempotencyKey(r); key != "" {
+		task.Name = t.TaskName(r.FormValue("queue"), key)
+	}
 
-	if r.Header.Get("X-AppEngine-TaskRetryCount") == "" {
-		http.Error(w, "Bad request", http.StatusBadRequest)
+	createdTask, err := t.AddToQueue(ctx, task, r.FormValue("queue"))
+	if err == taskqueue.ErrTaskAlreadyAdded {
+		writeAlreadyAdded(ctx, w, task.Name)
 		return
 	}
-
-	log.Infof(ctx, "Doing secret stuff")
-}
-
-func TriggerParamsTask(w http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
-	t := taskqueue.NewPOSTTask("/params", url.Values{"name": []string{"John Doe"}})
-
-	createdTask, err := taskqueue.Add(ctx, t, "slow-queue")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -208,16 +262,91 @@ func TriggerParamsTask(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func Params(_ http.ResponseWriter, r *http.Request) {
-	ctx := appengine.NewContext(r)
+func idempotencyKey(r *http.Request) string {
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		return key
+	}
+	return r.FormValue("idempotencyKey")
+}
 
-	if err := r.ParseForm(); err != nil {
-		log.Errorf(ctx, "Err: %+v", err)
+// writeAlreadyAdded responds with the record of a job whose task was added
+// before. The record is missing if the task was added by another request that
+// hasn't saved it yet, or if it has been deleted while the name is still
+// tombstoned.
+func writeAlreadyAdded(ctx context.Context, w http.ResponseWriter, name string) {
+	existing := struct {
+		TaskName string
+		Job      *job.Record `json:",omitempty"`
+	}{TaskName: name}
+
+	record, err := job.Get(ctx, name)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	existing.Job = record
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	if err := json.NewEncoder(w).Encode(existing); err != nil {
+		log.Errorf(ctx, "Error encoding response: %s", err)
+	}
+}
+
+// retryOptions parses "retryLimit", "ageLimit", "minBackoff", "maxBackoff"
+// and "maxDoublings" into options overriding the retry parameters of the
+// queue. It returns nil if none are given. The task queue ignores a retry
+// limit below 1, so those are rejected rather than silently dropped.
+func retryOptions(r *http.Request) (*taskqueue.RetryOptions, error) {
+	var opts taskqueue.RetryOptions
+	given := false
+
+	for _, param := range []struct {
+		name string
+		dst  *int32
+		min  int64
+	}{
+		{"retryLimit", &opts.RetryLimit, 1},
+		{"maxDoublings", &opts.MaxDoublings, 0},
+	} {
+		if value := r.FormValue(param.name); value != "" {
+			n, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", param.name, err)
+			}
+			if n < param.min {
+				return nil, fmt.Errorf("invalid %s: must be at least %d", param.name, param.min)
+			}
+			*param.dst = int32(n)
+			given = true
+		}
+	}
+	// Zero doublings means the backoff grows linearly from the start, which
+	// has to be asked for explicitly.
+	opts.ApplyZeroMaxDoublings = r.FormValue("maxDoublings") != "" && opts.MaxDoublings == 0
+
+	for _, param := range []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"ageLimit", &opts.AgeLimit},
+		{"minBackoff", &opts.MinBackoff},
+		{"maxBackoff", &opts.MaxBackoff},
+	} {
+		if value := r.FormValue(param.name); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", param.name, err)
+			}
+			*param.dst = d
+			given = true
+		}
+	}
 
-	log.Infof(ctx, "Got parameters: %+v", r.PostForm)
-	log.Infof(ctx, "Got headers: %+v", r.Header)
+	if !given {
+		return nil, nil
+	}
+	return &opts, nil
 }
 
 func WhichServiceDoesATaskRunOn(_ http.ResponseWriter, r *http.Request) {
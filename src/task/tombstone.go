@@ -0,0 +1,116 @@
+package task
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gabrielf/datastore-sandbox/src/repository"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/taskqueue"
+)
+
+// TombstoneProbe remembers when a named task was first added, keyed by the
+// task name.
+type TombstoneProbe struct {
+	TaskName string `datastore:"-"`
+	AddedAt  time.Time
+	Deleted  bool
+}
+
+func (p *TombstoneProbe) SetKey(key *datastore.Key) {
+	p.TaskName = key.StringID()
+}
+
+type tombstoneResult struct {
+	TombstoneProbe
+	Elapsed    time.Duration
+	Tombstoned bool
+}
+
+var tombstoneRepository = repository.New("TombstoneProbe")
+
+// Tombstone documents how long task names stay taken. Task names can't be
+// reused for some time after the task has run or been deleted, which is what
+// makes named tasks usable for deduplication but also limits how soon an
+// idempotency key can be used again.
+//
+// POST adds a named task, and deletes it right away with delete=true. GET with
+// the returned "name" tries to add a task with the same name again and reports
+// whether the name is still tombstoned and how long ago it was first added.
+func Tombstone(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	if r.Method == "POST" {
+		name := "tombstone-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		task, err := ParamsJob.NewTask(&ParamsPayload{Name: name})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		task.Name = name
+		if task, err = ParamsJob.Add(ctx, task); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		probe := TombstoneProbe{TaskName: name, AddedAt: time.Now()}
+		if r.FormValue("delete") == "true" {
+			if err := taskqueue.Delete(ctx, task, ParamsJob.Queue); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			probe.Deleted = true
+		}
+		if _, err := tombstoneRepository.Put(ctx, tombstoneRepository.NewKey(ctx, name, 0, nil), &probe); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeTombstoneResult(w, tombstoneResult{TombstoneProbe: probe, Tombstoned: true})
+		return
+	}
+
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "Missing name parameter", http.StatusBadRequest)
+		return
+	}
+	var probe TombstoneProbe
+	if err := tombstoneRepository.Get(ctx, tombstoneRepository.NewKey(ctx, name, 0, nil), &probe); err == datastore.ErrNoSuchEntity {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := tombstoneResult{TombstoneProbe: probe, Elapsed: time.Since(probe.AddedAt)}
+	task, err := ParamsJob.NewTask(&ParamsPayload{Name: name})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	task.Name = name
+	// Adding the task again runs the job again once the name is free, which
+	// is harmless for the params job.
+	_, err = ParamsJob.Add(ctx, task)
+	switch err {
+	case taskqueue.ErrTaskAlreadyAdded:
+		result.Tombstoned = true
+	case nil:
+		result.Tombstoned = false
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeTombstoneResult(w, result)
+}
+
+func writeTombstoneResult(w http.ResponseWriter, result tombstoneResult) {
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,260 @@
+package trace
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+// Operation is one datastore RPC made while serving a request.
+type Operation struct {
+	Kind     string
+	Op       string
+	Entities int
+	Latency  time.Duration
+	Err      string `json:",omitempty"`
+}
+
+type Trace struct {
+	mu         sync.Mutex
+	operations []Operation
+}
+
+// maxTraces is the number of traces kept at once. Traces are removed when
+// their request is done, the limit only matters if that's somehow skipped, in
+// which case the oldest traces are dropped.
+const maxTraces = 1000
+
+// Traces are looked up by request ID since handlers create their own context
+// with appengine.NewContext and there's no way to hand them a derived one.
+// traceIDs holds the IDs in the order they were added, as a ring.
+var (
+	tracesMu  sync.Mutex
+	traces    = map[string]*Trace{}
+	traceIDs  [maxTraces]string
+	nextTrace int
+)
+
+// Start times a datastore operation and returns a function that records it
+// in the trace of the request ctx belongs to when called with the outcome.
+// Operations outside of traced requests are not recorded.
+//
+//	done := trace.Start(ctx, "Category", "get")
+//	err := datastore.Get(ctx, key, dst)
+//	done(1, err)
+func Start(ctx context.Context, kind, op string) func(entities int, err error) {
+	start := time.Now()
+	return func(entities int, err error) {
+		t := lookup(ctx)
+		if t == nil {
+			return
+		}
+		operation := Operation{
+			Kind:     kind,
+			Op:       op,
+			Entities: entities,
+			Latency:  time.Since(start),
+		}
+		if err != nil {
+			operation.Err = err.Error()
+		}
+
+		t.mu.Lock()
+		t.operations = append(t.operations, operation)
+		t.mu.Unlock()
+	}
+}
+
+// Operations returns the operations recorded so far for the request ctx
+// belongs to.
+func Operations(ctx context.Context) []Operation {
+	t := lookup(ctx)
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Operation(nil), t.operations...)
+}
+
+// Handler traces the datastore operations made while h serves a request and
+// logs a summary when it's done. If the SERVER_TIMING environment variable is
+// "true", a Server-Timing header with the operations made before the response
+// is written is added as well.
+func Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := appengine.NewContext(r)
+		t, end := begin(ctx, r.URL.Path)
+		defer end()
+
+		if t != nil && os.Getenv("SERVER_TIMING") == "true" {
+			w = &timingWriter{ResponseWriter: w, trace: t}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Begin traces the datastore operations of the request ctx belongs to, for
+// code run by handlers that can't be wrapped with Handler such as delay
+// functions, which are all served by the delay package. Call the returned
+// function when done to log a summary under name.
+//
+//	defer trace.Begin(ctx, "migration-batch")()
+func Begin(ctx context.Context, name string) func() {
+	_, end := begin(ctx, name)
+	return end
+}
+
+// begin adds a trace for the request of ctx unless it's traced already, and
+// returns it together with the function that logs and removes it.
+func begin(ctx context.Context, name string) (*Trace, func()) {
+	id := appengine.RequestID(ctx)
+	if id == "" || lookup(ctx) != nil {
+		return nil, func() {}
+	}
+
+	t := &Trace{}
+	tracesMu.Lock()
+	if old := traceIDs[nextTrace]; old != "" {
+		delete(traces, old)
+	}
+	traceIDs[nextTrace] = id
+	nextTrace = (nextTrace + 1) % maxTraces
+	traces[id] = t
+	tracesMu.Unlock()
+
+	return t, func() {
+		tracesMu.Lock()
+		delete(traces, id)
+		tracesMu.Unlock()
+
+		if operations := t.snapshot(); len(operations) > 0 {
+			log.Infof(ctx, "Datastore operations for %s: %s", name, summarize(operations))
+		}
+	}
+}
+
+func lookup(ctx context.Context) *Trace {
+	id := appengine.RequestID(ctx)
+	if id == "" {
+		return nil
+	}
+	tracesMu.Lock()
+	defer tracesMu.Unlock()
+	return traces[id]
+}
+
+func (t *Trace) snapshot() []Operation {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Operation(nil), t.operations...)
+}
+
+type opTotals struct {
+	name     string
+	count    int
+	entities int
+	errors   int
+	latency  time.Duration
+}
+
+// totals groups operations by kind and op, sorted by total latency.
+func totals(operations []Operation) []opTotals {
+	byName := map[string]*opTotals{}
+	for _, op := range operations {
+		name := op.Op
+		if op.Kind != "" {
+			name = op.Kind + "." + op.Op
+		}
+		t, ok := byName[name]
+		if !ok {
+			t = &opTotals{name: name}
+			byName[name] = t
+		}
+		t.count += 1
+		t.entities += op.Entities
+		t.latency += op.Latency
+		if op.Err != "" {
+			t.errors += 1
+		}
+	}
+
+	result := make([]opTotals, 0, len(byName))
+	for _, t := range byName {
+		result = append(result, *t)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].latency > result[j].latency })
+	return result
+}
+
+func summarize(operations []Operation) string {
+	var total time.Duration
+	parts := []string{}
+	for _, t := range totals(operations) {
+		total += t.latency
+		part := fmt.Sprintf("%s x%d (%d entities, %s)", t.name, t.count, t.entities, t.latency)
+		if t.errors > 0 {
+			part += fmt.Sprintf(" %d errors", t.errors)
+		}
+		parts = append(parts, part)
+	}
+	return fmt.Sprintf("%d RPCs in %s: %s", len(operations), total, strings.Join(parts, ", "))
+}
+
+func serverTiming(operations []Operation) string {
+	var total time.Duration
+	metrics := []string{}
+	for _, t := range totals(operations) {
+		total += t.latency
+		metrics = append(metrics, fmt.Sprintf("%s;dur=%.1f;desc=\"%d\"", metricName(t.name), ms(t.latency), t.count))
+	}
+	metrics = append([]string{fmt.Sprintf("datastore;dur=%.1f;desc=\"%d RPCs\"", ms(total), len(operations))}, metrics...)
+	return strings.Join(metrics, ", ")
+}
+
+// metricName makes a Server-Timing metric name, which must be an HTTP token.
+func metricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// timingWriter adds the Server-Timing header just before the response header
+// is written.
+type timingWriter struct {
+	http.ResponseWriter
+	trace       *Trace
+	wroteHeader bool
+}
+
+func (w *timingWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if operations := w.trace.snapshot(); len(operations) > 0 {
+			w.Header().Set("Server-Timing", serverTiming(operations))
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,45 @@
+package transaction
+
+import (
+	"net/http"
+	"time"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	// MarkerTTL is how long an idempotency key is remembered, which is how
+	// long clients can retry a transaction without it being applied twice.
+	MarkerTTL = 7 * 24 * time.Hour
+
+	expireBatchSize  = 500
+	expireTimeBudget = 5 * time.Minute
+)
+
+// ExpireMarkers is run by cron and deletes the markers of transactions
+// committed more than MarkerTTL ago.
+func ExpireMarkers(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+	start := time.Now()
+	before := start.Add(-MarkerTTL)
+
+	deleted := 0
+	for time.Since(start) < expireTimeBudget {
+		q := markerRepository.NewQuery().Filter("CommittedAt <", before).Limit(expireBatchSize).KeysOnly()
+		keys, err := markerRepository.GetAll(ctx, q, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(keys) == 0 {
+			break
+		}
+		if err := markerRepository.DeleteMulti(ctx, keys); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		deleted += len(keys)
+	}
+	log.Infof(ctx, "Deleted %d transaction markers committed before %s", deleted, before)
+}
@@ -0,0 +1,95 @@
+package transaction
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	OutcomeCommitted = "committed"
+	OutcomeFailed    = "failed"
+	OutcomeDuplicate = "duplicate"
+)
+
+// Metrics describe one call to Run.
+type Metrics struct {
+	Name     string
+	Attempts int
+	Duration time.Duration
+	Outcome  string
+}
+
+// Totals aggregate the metrics of all transactions with the same name run by
+// this instance since it started.
+type Totals struct {
+	Transactions int
+	Committed    int
+	Failed       int
+	Duplicates   int
+	Attempts     int
+	Retries      int
+	MaxAttempts  int
+	Duration     time.Duration
+	MaxDuration  time.Duration
+}
+
+var (
+	totalsMu sync.Mutex
+	totals   = map[string]*Totals{}
+)
+
+func record(ctx context.Context, m Metrics) {
+	log.Infof(ctx, "Transaction %s: outcome=%s attempts=%d duration=%s", m.Name, m.Outcome, m.Attempts, m.Duration)
+
+	totalsMu.Lock()
+	defer totalsMu.Unlock()
+
+	t, ok := totals[m.Name]
+	if !ok {
+		t = &Totals{}
+		totals[m.Name] = t
+	}
+	t.Transactions += 1
+	t.Attempts += m.Attempts
+	t.Retries += m.Attempts - 1
+	t.Duration += m.Duration
+	if m.Attempts > t.MaxAttempts {
+		t.MaxAttempts = m.Attempts
+	}
+	if m.Duration > t.MaxDuration {
+		t.MaxDuration = m.Duration
+	}
+	switch m.Outcome {
+	case OutcomeCommitted:
+		t.Committed += 1
+	case OutcomeFailed:
+		t.Failed += 1
+	case OutcomeDuplicate:
+		t.Duplicates += 1
+	}
+}
+
+// Stats returns the transaction totals of the instance serving the request.
+func Stats(w http.ResponseWriter, r *http.Request) {
+	totalsMu.Lock()
+	snapshot := make(map[string]Totals, len(totals))
+	for name, t := range totals {
+		snapshot[name] = *t
+	}
+	totalsMu.Unlock()
+
+	result := struct {
+		InstanceID   string
+		Transactions map[string]Totals
+	}{appengine.InstanceID(), snapshot}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,293 @@
+package transaction
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/gabrielf/datastore-sandbox/src/repository"
+	"github.com/gabrielf/datastore-sandbox/src/trace"
+	"github.com/go-errors/errors"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+// MaxEntityGroups is the number of entity groups a cross-group transaction
+// may touch.
+const MaxEntityGroups = 25
+
+const (
+	ReasonTooManyGroups = "too-many-entity-groups"
+	ReasonXGRequired    = "cross-group-not-enabled"
+	ReasonContention    = "concurrent-transaction"
+	ReasonOther         = "other"
+)
+
+// Options configure Run. Attempts is the total number of attempts made when
+// the transaction collides with another one, sleeping between attempts for a
+// backoff that starts at Backoff and doubles up to MaxBackoff, with jitter.
+// Name identifies the transaction in logs and stats.
+//
+// If IdempotencyKey is set a marker entity for the key is written as part of
+// the transaction and a later transaction with the same Name, Scope and key
+// isn't run but fails with ErrAlreadyApplied. Scope is what the key applies
+// to, such as the root being written, so that a client reusing a key for
+// another endpoint or root isn't mistaken for a retry. The marker is an
+// entity group of its own so XG is switched on. Markers expire after
+// MarkerTTL.
+type Options struct {
+	Name           string
+	XG             bool
+	Attempts       int
+	Backoff        time.Duration
+	MaxBackoff     time.Duration
+	IdempotencyKey string
+	Scope          string
+}
+
+var DefaultOptions = Options{
+	Name:       "unnamed",
+	Attempts:   3,
+	Backoff:    50 * time.Millisecond,
+	MaxBackoff: 2 * time.Second,
+}
+
+var ErrAlreadyApplied = errors.New("transaction: already applied")
+
+// ErrInjectedFailure is returned by experiments that fail a transaction on
+// purpose to show what's rolled back with it.
+var ErrInjectedFailure = errors.New("transaction: injected failure")
+
+type inTransactionKey struct{}
+
+// Error describes why a transaction failed in a form that can be returned to
+// clients as JSON.
+type Error struct {
+	Reason   string
+	Groups   int `json:",omitempty"`
+	XG       bool
+	Attempts int
+	Message  string
+	Err      error `json:"-"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("transaction failed (%s): %s", e.Reason, e.Message)
+}
+
+type marker struct {
+	Name        string
+	CommittedAt time.Time
+}
+
+var markerRepository = repository.New("TransactionMarker")
+
+// Run runs f in a transaction, retrying on datastore.ErrConcurrentTransaction
+// with backoff. Every transaction is recorded in the stats. Errors returned by
+// f, such as a failed precondition, are returned as is, as is
+// ErrAlreadyApplied. Failures of the transaction itself, like contention or
+// hitting its limits, are returned as *Error with the reason classified.
+func Run(ctx context.Context, opts Options, f func(ctx context.Context) error) error {
+	opts = withDefaults(opts)
+	if opts.IdempotencyKey != "" {
+		opts.XG = true
+		f = guarded(opts, f)
+	}
+	inner := f
+	var fErr error
+	f = func(ctx context.Context) error {
+		fErr = inner(context.WithValue(ctx, inTransactionKey{}, true))
+		return fErr
+	}
+
+	start := time.Now()
+	backoff := opts.Backoff
+	attempts := 0
+	var err error
+	for attempts < opts.Attempts {
+		attempts += 1
+		done := trace.Start(ctx, "", "transaction")
+		err = datastore.RunInTransaction(ctx, f, &datastore.TransactionOptions{
+			XG:       opts.XG,
+			Attempts: 1,
+		})
+		done(0, err)
+		if err != datastore.ErrConcurrentTransaction || attempts == opts.Attempts {
+			break
+		}
+		time.Sleep(jitter(backoff))
+		if backoff *= 2; backoff > opts.MaxBackoff {
+			backoff = opts.MaxBackoff
+		}
+	}
+
+	metrics := Metrics{
+		Name:     opts.Name,
+		Attempts: attempts,
+		Duration: time.Since(start),
+		Outcome:  OutcomeCommitted,
+	}
+	switch {
+	case err == ErrAlreadyApplied:
+		metrics.Outcome = OutcomeDuplicate
+	case err != nil:
+		metrics.Outcome = OutcomeFailed
+	}
+	record(ctx, metrics)
+
+	if err == nil || err == ErrAlreadyApplied {
+		return err
+	}
+	if err == fErr && classify(err) == ReasonOther {
+		// Up to the caller to handle, and often expected.
+		log.Infof(ctx, "Transaction %s rolled back: %s", opts.Name, err)
+		return err
+	}
+	log.Errorf(ctx, "Transaction %s failed after %d attempts: %s", opts.Name, attempts, errors.Wrap(err, 0).ErrorStack())
+	if terr, ok := err.(*Error); ok {
+		return terr
+	}
+	return &Error{
+		Reason:   classify(err),
+		XG:       opts.XG,
+		Attempts: attempts,
+		Message:  err.Error(),
+		Err:      err,
+	}
+}
+
+// InTransaction reports whether ctx belongs to a transaction started by Run,
+// for code that has to work both in and out of one. Datastore doesn't allow
+// starting a transaction within another.
+func InTransaction(ctx context.Context) bool {
+	in, _ := ctx.Value(inTransactionKey{}).(bool)
+	return in
+}
+
+// guarded wraps f so that it's skipped if the marker for the idempotency key
+// exists and the marker is written together with the changes made by f.
+func guarded(opts Options, f func(ctx context.Context) error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		key := MarkerKey(ctx, opts)
+		var m marker
+		if err := markerRepository.Get(ctx, key, &m); err == nil {
+			return ErrAlreadyApplied
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		if err := f(ctx); err != nil {
+			return err
+		}
+
+		m = marker{Name: opts.Name, CommittedAt: time.Now()}
+		_, err := markerRepository.Put(ctx, key, &m)
+		return err
+	}
+}
+
+// MarkerKey returns the key of the marker a transaction with opts writes, or
+// nil if it has no idempotency key, for counting its entity groups up front.
+func MarkerKey(ctx context.Context, opts Options) *datastore.Key {
+	if opts.IdempotencyKey == "" {
+		return nil
+	}
+	return markerRepository.NewKey(ctx, markerName(opts), 0, nil)
+}
+
+// markerName identifies the marker of a transaction. The idempotency key is
+// chosen by clients and hashed, since key names are limited to 500 bytes.
+func markerName(opts Options) string {
+	sum := sha256.Sum256([]byte(opts.IdempotencyKey))
+	return opts.Name + "/" + opts.Scope + "/" + hex.EncodeToString(sum[:])
+}
+
+func withDefaults(opts Options) Options {
+	if opts.Name == "" {
+		opts.Name = DefaultOptions.Name
+	}
+	if opts.Attempts <= 0 {
+		opts.Attempts = DefaultOptions.Attempts
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = DefaultOptions.Backoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultOptions.MaxBackoff
+	}
+	return opts
+}
+
+// jitter returns a random duration between half and all of d so that
+// colliding transactions don't retry in lockstep.
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// CheckGroups fails fast, without a round trip to datastore, if keys span
+// more entity groups than a transaction with opts is allowed to touch. Like
+// Run it treats a transaction with an idempotency key as cross-group.
+func CheckGroups(opts Options, keys ...*datastore.Key) error {
+	groups := EntityGroups(keys...)
+	if opts.IdempotencyKey != "" {
+		opts.XG = true
+	}
+	if groups > 1 && !opts.XG {
+		return &Error{
+			Reason:   ReasonXGRequired,
+			Groups:   groups,
+			XG:       opts.XG,
+			Attempts: opts.Attempts,
+			Message:  fmt.Sprintf("%d entity groups requires a cross-group transaction", groups),
+		}
+	}
+	if groups > MaxEntityGroups {
+		return &Error{
+			Reason:   ReasonTooManyGroups,
+			Groups:   groups,
+			XG:       opts.XG,
+			Attempts: opts.Attempts,
+			Message:  fmt.Sprintf("%d entity groups exceeds the limit of %d", groups, MaxEntityGroups),
+		}
+	}
+	return nil
+}
+
+// EntityGroups counts the distinct entity groups, i.e. root keys, of keys.
+// Nil keys are skipped.
+func EntityGroups(keys ...*datastore.Key) int {
+	roots := map[string]bool{}
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		for key.Parent() != nil {
+			key = key.Parent()
+		}
+		roots[key.String()] = true
+	}
+	return len(roots)
+}
+
+// classify recognizes the errors datastore returns when a transaction hits
+// its limits. The limit errors are only distinguishable by their message.
+func classify(err error) string {
+	if err == datastore.ErrConcurrentTransaction {
+		return ReasonContention
+	}
+	message := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(message, "too many entity groups"):
+		return ReasonTooManyGroups
+	case strings.Contains(message, "cross-group transaction need to be explicitly specified"),
+		strings.Contains(message, "cross-group transactions need to be explicitly specified"):
+		return ReasonXGRequired
+	case strings.Contains(message, "concurrent transaction"), strings.Contains(message, "too much contention"):
+		return ReasonContention
+	}
+	return ReasonOther
+}
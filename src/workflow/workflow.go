@@ -0,0 +1,402 @@
+package workflow
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gabrielf/datastore-sandbox/src/repository"
+	"github.com/gabrielf/datastore-sandbox/src/trace"
+	"github.com/gabrielf/datastore-sandbox/src/transaction"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+)
+
+const (
+	defaultShards = 10
+	maxShards     = 100
+	maxAddBatch   = 100
+)
+
+// Options configure how a workflow is run. Shards is the number of entities
+// the countdown of remaining children is spread over, so that children
+// finishing at the same time don't contend for one entity.
+type Options struct {
+	Shards int
+	Queue  string
+}
+
+// Child identifies a child task of a workflow. It's passed as the first
+// argument after the context to the child function, which must call Complete
+// with it once its work is done.
+type Child struct {
+	Workflow string
+	Index    int
+}
+
+// Workflow is the state of a fan-out/fan-in run, keyed by its ID. The
+// completion task is created up front so that any delay.Function can be used,
+// and is added when the last child completes.
+type Workflow struct {
+	ID           string `datastore:"-"`
+	Children     int
+	Shards       int
+	Queue        string
+	DonePath     string `datastore:",noindex" json:"-"`
+	DonePayload  []byte `datastore:",noindex" json:"-"`
+	ShardsReady  bool
+	Finished     bool
+	CreatedAt    time.Time
+	FinishedAt   time.Time
+	DoneTaskName string `datastore:",noindex"`
+}
+
+func (w *Workflow) SetKey(key *datastore.Key) {
+	w.ID = key.StringID()
+}
+
+// shard holds the number of children left of those assigned to it. Shards
+// are root entities so that they are in entity groups of their own.
+type shard struct {
+	Remaining int
+}
+
+// childDone marks a child as completed. It's a child of the child's shard so
+// that it's written in the same transaction as the countdown.
+type childDone struct {
+	CompletedAt time.Time
+}
+
+var (
+	workflowRepository  = repository.New("Workflow")
+	shardRepository     = repository.New("WorkflowShard")
+	childDoneRepository = repository.New("WorkflowChildDone")
+)
+
+var checkFunc = delay.Func("workflow-check", Check)
+
+// validID matches IDs that can be part of task names.
+var validID = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,100}$`)
+
+// Start runs child once for each element of args in tasks of their own, with
+// a Child followed by the element as arguments, and runs done with doneArgs
+// exactly once after every child has called Complete:
+//
+//	var fetchPage = delay.Func("fetch-page", func(ctx context.Context, c workflow.Child, url string) error {
+//		...
+//		return workflow.Complete(ctx, c)
+//	})
+//	err := workflow.Start(ctx, "fetch-1", workflow.Options{}, fetchPage, [][]interface{}{{"a"}, {"b"}}, allFetched, "pages")
+//
+// The workflow is identified by id, which may only contain letters, digits,
+// '-' and '_'. If Start fails it can be called again with the same id and
+// arguments to resume the workflow: the countdown is only set up once and
+// child tasks are named after the id and their index, so children that were
+// already added aren't added again. The options and done task of the first
+// call are kept.
+func Start(ctx context.Context, id string, opts Options, child *delay.Function, args [][]interface{}, done *delay.Function, doneArgs ...interface{}) error {
+	if !validID.MatchString(id) {
+		return fmt.Errorf("workflow: invalid id %q", id)
+	}
+	if opts.Shards <= 0 {
+		opts.Shards = defaultShards
+	}
+	if opts.Shards > maxShards {
+		opts.Shards = maxShards
+	}
+	if opts.Shards > len(args) {
+		opts.Shards = len(args)
+	}
+
+	doneTask, err := done.Task(doneArgs...)
+	if err != nil {
+		return err
+	}
+	w := Workflow{
+		Children:    len(args),
+		Shards:      opts.Shards,
+		Queue:       opts.Queue,
+		DonePath:    doneTask.Path,
+		DonePayload: doneTask.Payload,
+		CreatedAt:   time.Now(),
+	}
+	key := workflowRepository.NewKey(ctx, id, 0, nil)
+	err = transaction.Run(ctx, transaction.Options{Name: "workflow-start"}, func(ctx context.Context) error {
+		var existing Workflow
+		err := workflowRepository.Get(ctx, key, &existing)
+		if err == datastore.ErrNoSuchEntity {
+			_, err = workflowRepository.Put(ctx, key, &w)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if existing.Children != len(args) {
+			return fmt.Errorf("workflow: %s was started with %d children, not %d", id, existing.Children, len(args))
+		}
+		w = existing
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Shards are only created if they don't exist, never reset, since
+	// children of a concurrent or earlier call may already be counting them
+	// down.
+	if !w.ShardsReady {
+		if err := createShards(ctx, &w); err != nil {
+			return err
+		}
+		err := transaction.Run(ctx, transaction.Options{Name: "workflow-start"}, func(ctx context.Context) error {
+			var current Workflow
+			if err := workflowRepository.Get(ctx, key, &current); err != nil {
+				return err
+			}
+			current.ShardsReady = true
+			_, err := workflowRepository.Put(ctx, key, &current)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if w.Children == 0 {
+		return checkFunc.Call(ctx, w.ID)
+	}
+
+	tasks := make([]*taskqueue.Task, len(args))
+	for i := range args {
+		if tasks[i], err = child.Task(append([]interface{}{Child{Workflow: w.ID, Index: i}}, args[i]...)...); err != nil {
+			return err
+		}
+		tasks[i].Name = fmt.Sprintf("workflow-%s-child-%d", w.ID, i)
+	}
+	for lo := 0; lo < len(tasks); lo += maxAddBatch {
+		hi := lo + maxAddBatch
+		if hi > len(tasks) {
+			hi = len(tasks)
+		}
+		if _, err := taskqueue.AddMulti(ctx, tasks[lo:hi], w.Queue); err != nil && !onlyAlreadyAdded(err) {
+			return err
+		}
+	}
+
+	log.Infof(ctx, "Started workflow %s with %d children over %d shards", w.ID, w.Children, w.Shards)
+	return nil
+}
+
+// Complete counts down the children left of the workflow c belongs to. It's
+// idempotent so that a child task that's retried after completing doesn't
+// count twice. When the shard of c reaches zero the workflow is checked for
+// completion in a task added in the same transaction.
+func Complete(ctx context.Context, c Child) error {
+	var w Workflow
+	if err := workflowRepository.Get(ctx, workflowRepository.NewKey(ctx, c.Workflow, 0, nil), &w); err != nil {
+		return err
+	}
+	if c.Index < 0 || c.Index >= w.Children {
+		return fmt.Errorf("workflow: %s has no child %d", c.Workflow, c.Index)
+	}
+
+	key := shardKey(ctx, c.Workflow, c.Index%w.Shards)
+	doneKey := childDoneRepository.NewKey(ctx, "", int64(c.Index)+1, key)
+	return transaction.Run(ctx, transaction.Options{Name: "workflow-complete"}, func(ctx context.Context) error {
+		var marker childDone
+		if err := childDoneRepository.Get(ctx, doneKey, &marker); err == nil {
+			return nil
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		var s shard
+		if err := shardRepository.Get(ctx, key, &s); err != nil {
+			return err
+		}
+		s.Remaining -= 1
+		if _, err := shardRepository.Put(ctx, key, &s); err != nil {
+			return err
+		}
+		if _, err := childDoneRepository.Put(ctx, doneKey, &childDone{CompletedAt: time.Now()}); err != nil {
+			return err
+		}
+		if s.Remaining == 0 {
+			return checkFunc.Call(ctx, c.Workflow)
+		}
+		return nil
+	})
+}
+
+// Check finishes the workflow if all shards have counted down to zero. Every
+// shard that reaches zero triggers a check in a task, and the last one to do
+// so always sees the others at zero. Finishing sets a flag in the same
+// transaction as the completion task is added, so it's added exactly once no
+// matter how many times Check is called.
+func Check(ctx context.Context, id string) error {
+	defer trace.Begin(ctx, "workflow-check")()
+
+	key := workflowRepository.NewKey(ctx, id, 0, nil)
+	var w Workflow
+	if err := workflowRepository.Get(ctx, key, &w); err != nil {
+		return err
+	}
+	if w.Finished {
+		return nil
+	}
+
+	remaining, err := countRemaining(ctx, &w)
+	if err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return nil
+	}
+
+	return transaction.Run(ctx, transaction.Options{Name: "workflow-check"}, func(ctx context.Context) error {
+		var w Workflow
+		if err := workflowRepository.Get(ctx, key, &w); err != nil {
+			return err
+		}
+		if w.Finished {
+			return nil
+		}
+
+		t, err := taskqueue.Add(ctx, &taskqueue.Task{Path: w.DonePath, Payload: w.DonePayload, Method: "POST"}, w.Queue)
+		if err != nil {
+			return err
+		}
+		w.Finished = true
+		w.FinishedAt = time.Now()
+		w.DoneTaskName = t.Name
+		_, err = workflowRepository.Put(ctx, key, &w)
+		return err
+	})
+}
+
+// createShards creates the shards of w that don't exist yet, each checked
+// and created in the same transaction, as many shards per cross-group
+// transaction as it allows.
+func createShards(ctx context.Context, w *Workflow) error {
+	counts := make([]int, w.Shards)
+	for i := 0; i < w.Children; i++ {
+		counts[i%w.Shards] += 1
+	}
+
+	for lo := 0; lo < w.Shards; lo += transaction.MaxEntityGroups {
+		hi := lo + transaction.MaxEntityGroups
+		if hi > w.Shards {
+			hi = w.Shards
+		}
+		err := transaction.Run(ctx, transaction.Options{Name: "workflow-shards", XG: true}, func(ctx context.Context) error {
+			keys := make([]*datastore.Key, hi-lo)
+			for i := range keys {
+				keys[i] = shardKey(ctx, w.ID, lo+i)
+			}
+			existing := make([]shard, len(keys))
+			err := shardRepository.GetMulti(ctx, keys, existing)
+			multiErr, isMultiErr := err.(appengine.MultiError)
+			if err != nil && !isMultiErr {
+				return err
+			}
+
+			var missingKeys []*datastore.Key
+			var missing []shard
+			for i, key := range keys {
+				if err == nil || multiErr[i] == nil {
+					continue
+				}
+				if multiErr[i] != datastore.ErrNoSuchEntity {
+					return multiErr[i]
+				}
+				missingKeys = append(missingKeys, key)
+				missing = append(missing, shard{Remaining: counts[lo+i]})
+			}
+			if len(missingKeys) == 0 {
+				return nil
+			}
+			_, err = shardRepository.PutMulti(ctx, missingKeys, missing)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func countRemaining(ctx context.Context, w *Workflow) (int, error) {
+	keys := make([]*datastore.Key, w.Shards)
+	for i := range keys {
+		keys[i] = shardKey(ctx, w.ID, i)
+	}
+	shards := make([]shard, w.Shards)
+	if err := shardRepository.GetMulti(ctx, keys, shards); err != nil {
+		return 0, err
+	}
+
+	remaining := 0
+	for _, s := range shards {
+		remaining += s.Remaining
+	}
+	return remaining, nil
+}
+
+func shardKey(ctx context.Context, id string, i int) *datastore.Key {
+	return shardRepository.NewKey(ctx, fmt.Sprintf("%s-%d", id, i), 0, nil)
+}
+
+func onlyAlreadyAdded(err error) bool {
+	multiErr, ok := err.(appengine.MultiError)
+	if !ok {
+		return false
+	}
+	for _, err := range multiErr {
+		if err != nil && err != taskqueue.ErrTaskAlreadyAdded {
+			return false
+		}
+	}
+	return true
+}
+
+type status struct {
+	Workflow
+	Remaining int
+}
+
+// Status shows the workflow given by "id" and how many of its children are
+// left.
+func Status(w http.ResponseWriter, r *http.Request) {
+	ctx := appengine.NewContext(r)
+
+	id := r.FormValue("id")
+	if id == "" {
+		http.Error(w, "Missing id parameter", http.StatusBadRequest)
+		return
+	}
+
+	var s status
+	var err error
+	if err := workflowRepository.Get(ctx, workflowRepository.NewKey(ctx, id, 0, nil), &s.Workflow); err == datastore.ErrNoSuchEntity {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if s.Remaining, err = countRemaining(ctx, &s.Workflow); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
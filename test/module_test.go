@@ -1,14 +1,24 @@
 package test
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 
 	_ "github.com/gabrielf/datastore-sandbox/app"
+	"github.com/gabrielf/datastore-sandbox/src/repository"
+	"github.com/gabrielf/datastore-sandbox/src/transaction"
+	"github.com/gabrielf/datastore-sandbox/src/workflow"
 	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/aetest"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
 )
 
 func TestWriteLogEntry(t *testing.T) {
@@ -45,3 +55,530 @@ func TestWriteLogEntryInTransaction(t *testing.T) {
 	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
 	Expect(strings.TrimSpace(res.Body.String())).To(Equal(`{"LogEntries":1}`))
 }
+
+func TestUpdateCategoryRequiresMatchingETag(t *testing.T) {
+	RegisterTestingT(t)
+
+	instance, err := aetest.NewInstance(nil)
+	Expect(err).ToNot(HaveOccurred())
+	defer instance.Close()
+
+	req, err := instance.NewRequest("POST", "/", strings.NewReader("name=Books"))
+	Expect(err).ToNot(HaveOccurred())
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	Expect(res.Header().Get("ETag")).To(Equal(`"1"`))
+
+	var created struct{ Key string }
+	Expect(json.Unmarshal(res.Body.Bytes(), &created)).To(Succeed())
+
+	update := func(ifMatch string) *httptest.ResponseRecorder {
+		body := url.Values{"key": {created.Key}, "name": {"Novels"}}.Encode()
+		req, err := instance.NewRequest("PUT", "/", strings.NewReader(body))
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("If-Match", ifMatch)
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		return res
+	}
+
+	res = update(`"1"`)
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	Expect(res.Header().Get("ETag")).To(Equal(`"2"`))
+	Expect(res.Header().Get("Vary")).To(Equal("Accept-Language"))
+
+	res = update(`"1"`)
+	Expect(res.Code).To(Equal(http.StatusPreconditionFailed), res.Body.String())
+	Expect(res.Header().Get("Vary")).To(Equal("Accept-Language"))
+
+	// The ETag of a localized body names its locale, If-Match only compares
+	// the version.
+	res = serve(instance, "GET", "/?locale=sv&key="+url.QueryEscape(created.Key))
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	Expect(res.Header().Get("ETag")).To(Equal(`"2-"`))
+
+	res = update(`"2-"`)
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	Expect(res.Header().Get("ETag")).To(Equal(`"3"`))
+
+	res = update(`W/"3"`)
+	Expect(res.Code).To(Equal(http.StatusPreconditionFailed), res.Body.String())
+}
+
+func TestWriteLogEntryInTransactionPerRoot(t *testing.T) {
+	RegisterTestingT(t)
+
+	instance, err := aetest.NewInstance(nil)
+	Expect(err).ToNot(HaveOccurred())
+	defer instance.Close()
+
+	for _, path := range []string{"/roots/first/logtrans", "/roots/second/logtrans", "/roots/second/logtrans"} {
+		req, err := instance.NewRequest("GET", path, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		res := httptest.NewRecorder()
+
+		http.DefaultServeMux.ServeHTTP(res, req)
+
+		Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	}
+
+	req, err := instance.NewRequest("GET", "/roots/second/logtrans", nil)
+	Expect(err).ToNot(HaveOccurred())
+
+	res := httptest.NewRecorder()
+
+	http.DefaultServeMux.ServeHTTP(res, req)
+
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	Expect(strings.TrimSpace(res.Body.String())).To(Equal(`{"LogEntries":3}`))
+}
+
+var (
+	workflowChild = delay.Func("test-workflow-child", func(ctx context.Context, c workflow.Child) error {
+		return workflow.Complete(ctx, c)
+	})
+	workflowDone = delay.Func("test-workflow-done", func(ctx context.Context) error {
+		return nil
+	})
+)
+
+func TestWorkflowCompletesOnce(t *testing.T) {
+	RegisterTestingT(t)
+
+	instance, err := aetest.NewInstance(nil)
+	Expect(err).ToNot(HaveOccurred())
+	defer instance.Close()
+
+	req, err := instance.NewRequest("GET", "/", nil)
+	Expect(err).ToNot(HaveOccurred())
+	ctx := appengine.NewContext(req)
+
+	args := [][]interface{}{{}, {}, {}}
+	Expect(workflow.Start(ctx, "test", workflow.Options{Shards: 2}, workflowChild, args, workflowDone)).To(Succeed())
+
+	type status struct {
+		Remaining    int
+		Finished     bool
+		DoneTaskName string
+	}
+	getStatus := func() status {
+		req, err := instance.NewRequest("GET", "/workflows?id=test", nil)
+		Expect(err).ToNot(HaveOccurred())
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+
+		var s status
+		Expect(json.Unmarshal(res.Body.Bytes(), &s)).To(Succeed())
+		return s
+	}
+
+	// A retried child completes twice but is only counted once.
+	Expect(workflow.Complete(ctx, workflow.Child{Workflow: "test", Index: 0})).To(Succeed())
+	Expect(workflow.Complete(ctx, workflow.Child{Workflow: "test", Index: 0})).To(Succeed())
+	Expect(getStatus().Remaining).To(Equal(2))
+
+	Expect(workflow.Complete(ctx, workflow.Child{Workflow: "test", Index: 1})).To(Succeed())
+	Expect(workflow.Complete(ctx, workflow.Child{Workflow: "test", Index: 2})).To(Succeed())
+
+	// Both shards reaching zero trigger a check, only the first finishes.
+	Expect(workflow.Check(ctx, "test")).To(Succeed())
+	finished := getStatus()
+	Expect(finished.Remaining).To(Equal(0))
+	Expect(finished.Finished).To(BeTrue())
+	Expect(finished.DoneTaskName).ToNot(BeEmpty())
+
+	Expect(workflow.Check(ctx, "test")).To(Succeed())
+	Expect(getStatus().DoneTaskName).To(Equal(finished.DoneTaskName))
+}
+
+func TestFailedFollowUpRollsBackLogEntryAndTask(t *testing.T) {
+	RegisterTestingT(t)
+
+	instance, err := aetest.NewInstance(nil)
+	Expect(err).ToNot(HaveOccurred())
+	defer instance.Close()
+
+	res := serve(instance, "POST", "/followup/log?queue=default")
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	Expect(strings.TrimSpace(res.Body.String())).To(Equal(`{"LogEntries":1}`))
+
+	res = serve(instance, "POST", "/followup/log?queue=default&fail=true")
+	Expect(res.Code).To(Equal(http.StatusInternalServerError), res.Body.String())
+	taskName := res.Header().Get("X-Task-Name")
+	Expect(taskName).ToNot(BeEmpty())
+
+	res = serve(instance, "GET", "/jobs?task="+url.QueryEscape(taskName))
+	Expect(res.Code).To(Equal(http.StatusNotFound), res.Body.String())
+
+	res = serve(instance, "GET", "/logtrans")
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	Expect(strings.TrimSpace(res.Body.String())).To(Equal(`{"LogEntries":2}`))
+}
+
+func TestBatchRecordsEnqueuedJobs(t *testing.T) {
+	RegisterTestingT(t)
+
+	instance, err := aetest.NewInstance(nil)
+	Expect(err).ToNot(HaveOccurred())
+	defer instance.Close()
+
+	res := serve(instance, "POST", "/triggerBatch?n=3&queue=default")
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	var result struct {
+		Added int
+		Tasks []struct{ Name string }
+	}
+	Expect(json.Unmarshal(res.Body.Bytes(), &result)).To(Succeed())
+	Expect(result.Added).To(Equal(3))
+
+	for _, task := range result.Tasks {
+		res = serve(instance, "GET", "/jobs?task="+url.QueryEscape(task.Name))
+		Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+		var record struct{ Type, Queue, State string }
+		Expect(json.Unmarshal(res.Body.Bytes(), &record)).To(Succeed())
+		Expect(record.Type).To(Equal("params"))
+		Expect(record.Queue).To(Equal("default"))
+		Expect(record.State).To(Equal("queued"))
+	}
+}
+
+func TestLogRetentionRequiresPositiveMaxAge(t *testing.T) {
+	RegisterTestingT(t)
+
+	instance, err := aetest.NewInstance(nil)
+	Expect(err).ToNot(HaveOccurred())
+	defer instance.Close()
+
+	res := serve(instance, "GET", "/log")
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+
+	for _, maxAge := range []string{"0s", "-1h", "soon"} {
+		res = serve(instance, "GET", "/log/retention?maxAge="+maxAge)
+		Expect(res.Code).To(Equal(http.StatusBadRequest), maxAge)
+	}
+
+	res = serve(instance, "GET", "/log/retention?maxAge=1h")
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+
+	// Deleting runs in a task per root, the entry is left until then.
+	res = serve(instance, "GET", "/logtrans")
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	Expect(strings.TrimSpace(res.Body.String())).To(Equal(`{"LogEntries":2}`))
+}
+
+func TestCategoryVersions(t *testing.T) {
+	RegisterTestingT(t)
+
+	instance, err := aetest.NewInstance(&aetest.Options{StronglyConsistentDatastore: true})
+	Expect(err).ToNot(HaveOccurred())
+	defer instance.Close()
+
+	res := serve(instance, "POST", "/?name=Books&name.sv=Bocker")
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	var books struct{ Key string }
+	Expect(json.Unmarshal(res.Body.Bytes(), &books)).To(Succeed())
+
+	type version struct {
+		Name          string
+		CategoryCount int
+	}
+	createVersion := func(name string, count int) {
+		res := serve(instance, "POST", "/versions?name="+name)
+		Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+		var v version
+		Expect(json.Unmarshal(res.Body.Bytes(), &v)).To(Succeed())
+		Expect(v).To(Equal(version{Name: name, CategoryCount: count}))
+	}
+	createVersion("v1", 1)
+
+	res = serve(instance, "POST", "/versions?name=v1")
+	Expect(res.Code).To(Equal(http.StatusConflict), res.Body.String())
+
+	body := url.Values{"key": {books.Key}, "name": {"Novels"}, "name.sv": {"Romaner"}, "name.de": {"Romane"}}.Encode()
+	req, err := instance.NewRequest("PUT", "/", strings.NewReader(body))
+	Expect(err).ToNot(HaveOccurred())
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("If-Match", `"1"`)
+	res = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+
+	res = serve(instance, "POST", "/?name=Music")
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	createVersion("v2", 2)
+
+	res = serve(instance, "GET", "/versions/diff?from=v1&to=v2")
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	var diff struct {
+		Added      []struct{ Name string }
+		Removed    []struct{ Name string }
+		Renamed    []struct{ From, To string }
+		Translated []struct{ Locale, From, To string }
+	}
+	Expect(json.Unmarshal(res.Body.Bytes(), &diff)).To(Succeed())
+	Expect(diff.Added).To(HaveLen(1))
+	Expect(diff.Added[0].Name).To(Equal("Music"))
+	Expect(diff.Removed).To(BeEmpty())
+	Expect(diff.Renamed).To(HaveLen(1))
+	Expect(diff.Renamed[0].From).To(Equal("Books"))
+	Expect(diff.Renamed[0].To).To(Equal("Novels"))
+	Expect(diff.Translated).To(ConsistOf(
+		struct{ Locale, From, To string }{"sv", "Bocker", "Romaner"},
+		struct{ Locale, From, To string }{"de", "", "Romane"},
+	))
+
+	// The first version still serves the categories as they were.
+	res = serve(instance, "GET", "/?version=v1&name=Books")
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	Expect(res.Body.String()).To(ContainSubstring(`"Name":"Books"`))
+}
+
+func TestIdempotentTransactionIsAppliedOnce(t *testing.T) {
+	RegisterTestingT(t)
+
+	instance, err := aetest.NewInstance(nil)
+	Expect(err).ToNot(HaveOccurred())
+	defer instance.Close()
+
+	req, err := instance.NewRequest("GET", "/", nil)
+	Expect(err).ToNot(HaveOccurred())
+	ctx := appengine.NewContext(req)
+
+	// Keys longer than a key name may be are fine too.
+	opts := transaction.Options{Name: "test", IdempotencyKey: strings.Repeat("k", 1000), Scope: "root"}
+	applied := 0
+	apply := func(ctx context.Context) error {
+		applied++
+		return nil
+	}
+
+	Expect(transaction.Run(ctx, opts, apply)).To(Succeed())
+	Expect(transaction.Run(ctx, opts, apply)).To(Equal(transaction.ErrAlreadyApplied))
+	Expect(applied).To(Equal(1))
+
+	// The key only applies within its scope.
+	opts.Scope = "other"
+	Expect(transaction.Run(ctx, opts, apply)).To(Succeed())
+	Expect(applied).To(Equal(2))
+
+	// Errors of the callback are returned as is and leave no marker.
+	failed := errors.New("failed")
+	opts.IdempotencyKey = "failing"
+	Expect(transaction.Run(ctx, opts, func(ctx context.Context) error { return failed })).To(Equal(failed))
+	Expect(transaction.Run(ctx, opts, apply)).To(Succeed())
+	Expect(applied).To(Equal(3))
+}
+
+func TestReplayDeadLetter(t *testing.T) {
+	RegisterTestingT(t)
+
+	instance, err := aetest.NewInstance(nil)
+	Expect(err).ToNot(HaveOccurred())
+	defer instance.Close()
+
+	// The last attempt the unstable job is allowed, failing.
+	req, err := instance.NewRequest("POST", "/unstable", strings.NewReader(`{"FailCount":10}`))
+	Expect(err).ToNot(HaveOccurred())
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-AppEngine-TaskName", "dead-task")
+	req.Header.Set("X-AppEngine-QueueName", "default")
+	req.Header.Set("X-AppEngine-TaskRetryCount", "4")
+	res := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+
+	res = serve(instance, "GET", "/jobs/dead?task=dead-task")
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	var letter struct{ Type, Queue string }
+	Expect(json.Unmarshal(res.Body.Bytes(), &letter)).To(Succeed())
+	Expect(letter.Type).To(Equal("unstable"))
+	Expect(letter.Queue).To(Equal("default"))
+
+	res = serve(instance, "POST", "/jobs/dead?task=dead-task&action=replay")
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	var replayed struct{ TaskName string }
+	Expect(json.Unmarshal(res.Body.Bytes(), &replayed)).To(Succeed())
+
+	// Replayed on the queue it failed on rather than the job's own.
+	res = serve(instance, "GET", "/jobs?task="+url.QueryEscape(replayed.TaskName))
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	var record struct{ Type, Queue, State string }
+	Expect(json.Unmarshal(res.Body.Bytes(), &record)).To(Succeed())
+	Expect(record.Type).To(Equal("unstable"))
+	Expect(record.Queue).To(Equal("default"))
+	Expect(record.State).To(Equal("queued"))
+
+	res = serve(instance, "POST", "/jobs/dead?task=dead-task&action=replay")
+	Expect(res.Code).To(Equal(http.StatusNotFound), res.Body.String())
+}
+
+type testEntity struct {
+	Value int
+}
+
+func TestRepositoryPageAndGetMulti(t *testing.T) {
+	RegisterTestingT(t)
+
+	instance, err := aetest.NewInstance(&aetest.Options{StronglyConsistentDatastore: true})
+	Expect(err).ToNot(HaveOccurred())
+	defer instance.Close()
+
+	req, err := instance.NewRequest("GET", "/", nil)
+	Expect(err).ToNot(HaveOccurred())
+	ctx := appengine.NewContext(req)
+	repo := repository.New("TestEntity")
+
+	// Keys in two GetMulti batches, only the first and last exist.
+	keys := make([]*datastore.Key, repository.MaxGetBatch+1)
+	for i := range keys {
+		keys[i] = repo.NewKey(ctx, "", int64(i+1), nil)
+	}
+	last := len(keys) - 1
+	_, err = repo.PutMulti(ctx, []*datastore.Key{keys[0], keys[last]}, []testEntity{{1}, {2}})
+	Expect(err).ToNot(HaveOccurred())
+
+	entities := make([]testEntity, len(keys))
+	err = repo.GetMulti(ctx, keys, entities)
+	Expect(err).To(BeAssignableToTypeOf(appengine.MultiError{}))
+	multiErr := err.(appengine.MultiError)
+	Expect(multiErr).To(HaveLen(len(keys)))
+	for i, err := range multiErr {
+		if i == 0 || i == last {
+			Expect(err).ToNot(HaveOccurred())
+		} else {
+			Expect(err).To(Equal(datastore.ErrNoSuchEntity))
+		}
+	}
+	Expect(entities[0].Value).To(Equal(1))
+	Expect(entities[last].Value).To(Equal(2))
+
+	_, err = repo.Put(ctx, repo.NewIncompleteKey(ctx, nil), &testEntity{3})
+	Expect(err).ToNot(HaveOccurred())
+	q := repo.NewQuery().Order("Value")
+
+	var page []testEntity
+	_, cursor, err := repo.Page(ctx, q, "", 2, &page)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(page).To(Equal([]testEntity{{1}, {2}}))
+	Expect(cursor).ToNot(BeEmpty())
+
+	page = nil
+	_, cursor, err = repo.Page(ctx, q, cursor, 2, &page)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(page).To(Equal([]testEntity{{3}}))
+	Expect(cursor).To(BeEmpty())
+
+	// A page that ends with the last result has no next page either.
+	page = nil
+	_, cursor, err = repo.Page(ctx, q, "", 3, &page)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(page).To(HaveLen(3))
+	Expect(cursor).To(BeEmpty())
+
+	page = nil
+	keys, cursor, err = repo.Page(ctx, q, "", 0, &page)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(keys).To(BeEmpty())
+	Expect(cursor).To(BeEmpty())
+}
+
+func TestIdempotentTaskIsAddedOnce(t *testing.T) {
+	RegisterTestingT(t)
+
+	instance, err := aetest.NewInstance(nil)
+	Expect(err).ToNot(HaveOccurred())
+	defer instance.Close()
+
+	add := func() *httptest.ResponseRecorder {
+		req, err := instance.NewRequest("POST", "/triggerParamsTask?queue=default", nil)
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Idempotency-Key", "order-1")
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		return res
+	}
+
+	res := add()
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	var added struct{ Name string }
+	Expect(json.Unmarshal(res.Body.Bytes(), &added)).To(Succeed())
+	Expect(added.Name).ToNot(BeEmpty())
+
+	res = add()
+	Expect(res.Code).To(Equal(http.StatusConflict), res.Body.String())
+	var existing struct {
+		TaskName string
+		Job      struct{ Type, State string }
+	}
+	Expect(json.Unmarshal(res.Body.Bytes(), &existing)).To(Succeed())
+	Expect(existing.TaskName).To(Equal(added.Name))
+	Expect(existing.Job.Type).To(Equal("params"))
+	Expect(existing.Job.State).To(Equal("queued"))
+}
+
+func TestCategoryLocaleFallback(t *testing.T) {
+	RegisterTestingT(t)
+
+	instance, err := aetest.NewInstance(nil)
+	Expect(err).ToNot(HaveOccurred())
+	defer instance.Close()
+
+	res := serve(instance, "POST", "/?name=Books&name.sv=Bocker&name.de=Buecher")
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	var created struct{ Key string }
+	Expect(json.Unmarshal(res.Body.Bytes(), &created)).To(Succeed())
+
+	type localized struct{ LocalizedName, Locale string }
+	get := func(path, acceptLanguage, ifNoneMatch string) (*httptest.ResponseRecorder, localized) {
+		req, err := instance.NewRequest("GET", path+"&key="+url.QueryEscape(created.Key), nil)
+		Expect(err).ToNot(HaveOccurred())
+		req.Header.Set("Accept-Language", acceptLanguage)
+		req.Header.Set("If-None-Match", ifNoneMatch)
+		res := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(res, req)
+		var l localized
+		if res.Code == http.StatusOK {
+			Expect(json.Unmarshal(res.Body.Bytes(), &l)).To(Succeed())
+		}
+		return res, l
+	}
+
+	// sv-SE falls back to sv, which is preferred over de.
+	res, l := get("/?", "de;q=0.5, sv-SE", "")
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	Expect(l).To(Equal(localized{"Bocker", "sv"}))
+	Expect(res.Header().Get("ETag")).To(Equal(`"1-sv"`))
+	Expect(res.Header().Get("Vary")).To(Equal("Accept-Language"))
+
+	// Without a translation the untranslated name is used.
+	res, l = get("/?", "fr", "")
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	Expect(l).To(Equal(localized{"Books", ""}))
+	Expect(res.Header().Get("ETag")).To(Equal(`"1-"`))
+
+	// The locale form value takes precedence over the header.
+	res, l = get("/?locale=de", "sv", "")
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+	Expect(l).To(Equal(localized{"Buecher", "de"}))
+
+	// A cached body is only current in the locale it was served in.
+	res, _ = get("/?", "sv", `"1-sv"`)
+	Expect(res.Code).To(Equal(http.StatusNotModified), res.Body.String())
+	res, _ = get("/?", "de", `"1-sv"`)
+	Expect(res.Code).To(Equal(http.StatusOK), res.Body.String())
+}
+
+// serve makes a request to the app. Form values are passed in the query
+// string, which FormValue reads for POSTs as well.
+func serve(instance aetest.Instance, method, path string) *httptest.ResponseRecorder {
+	req, err := instance.NewRequest(method, path, nil)
+	Expect(err).ToNot(HaveOccurred())
+	res := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(res, req)
+	return res
+}